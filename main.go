@@ -2,41 +2,149 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/godbus/dbus/v5"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
+	_ "modernc.org/sqlite"
 )
 
 type Config struct {
-	Interval int `yaml:"interval"`
+	// Interval is the polling interval in seconds (fractions allowed).
+	// Every poll reads sysfs, which on most laptops is a round trip to
+	// the embedded controller, so very short intervals cost CPU wakeups
+	// and can slow down the EC.
+	Interval float64 `yaml:"interval"`
+	// MinInterval is the floor in seconds below which a warning is
+	// logged at startup (default 1).
+	MinInterval float64 `yaml:"min_interval"`
+	// Source selects where battery data is read from: "sysfs" (default)
+	// or "upower" (the org.freedesktop.UPower D-Bus service).
+	Source string `yaml:"source"`
+	// SysfsPath is the power_supply class directory (default
+	// /sys/class/power_supply), e.g. where a container bind-mounts the
+	// host's sysfs. Powercap zones are read from its sibling powercap
+	// directory.
+	SysfsPath string `yaml:"sysfs_path"`
+
+	// StaleAfter is how many seconds a battery may go without a successful
+	// read before its series are removed, so a dead sensor doesn't keep
+	// reporting its last value. 0 disables.
+	StaleAfter int `yaml:"stale_after"`
+
+	// ClockOffset is added, in seconds, to the timestamps sent to outputs
+	// and scraped with prometheus.timestamps, for hosts whose clock is
+	// known to be off (e.g. a wrong RTC until NTP syncs).
+	ClockOffset float64 `yaml:"clock_offset"`
+	// ServerTimestamps sends InfluxDB points and Kafka messages without a
+	// timestamp so the server assigns its own on arrival.
+	ServerTimestamps bool `yaml:"server_timestamps"`
+
+	// CollectWhen pauses collection while its condition is false, to save
+	// the energy of polling on ultra-low-power devices. Command is run
+	// with sh -c and must exit 0; File must read Value (default "1").
+	// When both are set, both must hold.
+	CollectWhen struct {
+		Command string `yaml:"command"`
+		File    string `yaml:"file"`
+		Value   string `yaml:"value"`
+	} `yaml:"collect_when"`
+
+	// ScrapeFailureThreshold is how many consecutive failed reads it takes
+	// to set battery_last_scrape_success to 0 (default 1), so a one-off
+	// EC hiccup does not flap it. Any successful read resets the count.
+	ScrapeFailureThreshold int `yaml:"scrape_failure_threshold"`
+	// BackendInit is what to do when an output fails to initialize at
+	// startup: fatal, warn (run without it) or retry (default).
+	BackendInit string `yaml:"backend_init"`
+	// StartupWait is how many seconds to keep polling for batteries at
+	// startup before giving up, for hardware where power_supply entries
+	// appear late during boot.
+	StartupWait int `yaml:"startup_wait"`
+	// RescanInterval is how many seconds pass between looking for
+	// batteries that appeared or disappeared (default 60). Negative
+	// disables rescanning.
+	RescanInterval int `yaml:"rescan_interval"`
 
 	Prometheus struct {
 		Enabled bool   `yaml:"enabled"`
 		Port    int    `yaml:"port"`
 		Path    string `yaml:"path"`
+		// BasePath is prepended to every HTTP endpoint, for reverse proxies
+		// that strip a path prefix (e.g. "/power").
+		BasePath string `yaml:"base_path"`
+		// Listeners serves the same metrics on several addresses. When
+		// empty a single listener on Port is used, with TLS and BasicAuth.
+		Listeners []ListenerConfig `yaml:"listeners"`
+		TLS       TLSConfig        `yaml:"tls"`
+		BasicAuth BasicAuthConfig  `yaml:"basic_auth"`
+		// Timestamps attaches the sysfs read time to scraped battery
+		// metrics instead of letting Prometheus use the scrape time.
+		Timestamps bool `yaml:"timestamps"`
+		// NativeHistograms additionally exposes battery_power_draw_watts
+		// as a native histogram. Classic buckets are kept for scrapers
+		// without native histogram support.
+		NativeHistograms bool `yaml:"native_histograms"`
+		// Metrics limits the scrape endpoint to these metric names; empty
+		// serves everything.
+		Metrics []string `yaml:"metrics"`
+		// ExportedInstance adds an exported_instance label to every
+		// metric. When set, a ?target= query parameter overrides the
+		// value per request, for proxies scraping many exporters.
+		ExportedInstance string `yaml:"exported_instance"`
+		// Help overrides the help text of metrics by name.
+		Help map[string]string `yaml:"help"`
 	} `yaml:"prometheus"`
 
 	Pushgateway struct {
 		Enabled bool   `yaml:"enabled"`
 		URL     string `yaml:"url"`
 		Job     string `yaml:"job"`
+		// Metrics limits what is pushed to these metric names; empty
+		// pushes everything.
+		Metrics []string `yaml:"metrics"`
 	} `yaml:"pushgateway"`
 
 	InfluxDB struct {
@@ -45,11 +153,221 @@ type Config struct {
 		Token   string `yaml:"token"`
 		Org     string `yaml:"org"`
 		Bucket  string `yaml:"bucket"`
+		// Version 1 writes to InfluxDB 1.8+ through its v2 compatibility
+		// API: Username/Password replace Token, Org is unused and Bucket
+		// is "database/retention-policy" (or just "database"). Default 2.
+		Version  int    `yaml:"version"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		// Blocking writes each point synchronously and reports errors
+		// immediately instead of buffering them in the background.
+		Blocking bool `yaml:"blocking"`
+		// VersionTag adds the exporter build version as a tag on every point.
+		VersionTag bool `yaml:"version_tag"`
+		// FieldMap renames emitted fields (e.g. percentage: charge_pct)
+		// to match existing dashboards.
+		FieldMap map[string]string `yaml:"field_map"`
+		// GZip compresses write requests, e.g. on metered connections.
+		GZip bool `yaml:"gzip"`
+		// Consistency is the InfluxDB Enterprise write consistency: any,
+		// one, quorum or all. Empty leaves it to the server.
+		Consistency string `yaml:"consistency"`
 	} `yaml:"influxdb"`
 
+	Kafka struct {
+		Enabled bool     `yaml:"enabled"`
+		Brokers []string `yaml:"brokers"`
+		Topic   string   `yaml:"topic"`
+		TLS     bool     `yaml:"tls"`
+		SASL    struct {
+			Mechanism string `yaml:"mechanism"` // plain, scram-sha-256 or scram-sha-512
+			Username  string `yaml:"username"`
+			Password  string `yaml:"password"`
+		} `yaml:"sasl"`
+	} `yaml:"kafka"`
+
+	// NATS publishes the per-cycle JSON payload to Subject, optionally
+	// through JetStream so messages persist in a stream covering Subject.
+	NATS struct {
+		Enabled bool   `yaml:"enabled"`
+		URL     string `yaml:"url"`
+		Subject string `yaml:"subject"`
+		// Credentials is a .creds file; Username/Password or Token can
+		// be used instead.
+		Credentials string `yaml:"credentials"`
+		Username    string `yaml:"username"`
+		Password    string `yaml:"password"`
+		Token       string `yaml:"token"`
+		JetStream   bool   `yaml:"jetstream"`
+	} `yaml:"nats"`
+
+	// SQLite inserts one row per battery per cycle into a local database
+	// file, for offline analysis on field devices.
+	SQLite struct {
+		Enabled bool   `yaml:"enabled"`
+		Path    string `yaml:"path"`
+	} `yaml:"sqlite"`
+
+	// Sampling reads each uevent several times per cycle and keeps the
+	// per-field median, to filter out single garbage readings from the EC.
+	Sampling struct {
+		Enabled bool `yaml:"enabled"`
+		Samples int  `yaml:"samples"`
+		DelayMs int  `yaml:"delay_ms"`
+	} `yaml:"sampling"`
+
+	// DesignCapacityWh overrides ENERGY_FULL_DESIGN per battery when the
+	// reported value is missing or implausible (e.g. BAT0: 50). Charge-based
+	// batteries get CHARGE_FULL_DESIGN converted with VOLTAGE_MIN_DESIGN.
+	DesignCapacityWh map[string]float64 `yaml:"design_capacity_wh"`
+
+	// ChargeTarget is the charge percentage per battery at which
+	// battery_charge_target_reached becomes 1. Falls back to the sysfs
+	// charge_control_end_threshold when not set.
+	ChargeTarget map[string]int `yaml:"charge_target"`
+
+	// ChargeFloor is the charge percentage per battery below which
+	// charge_control lets the battery charge again.
+	ChargeFloor map[string]int `yaml:"charge_floor"`
+
+	// ChargeControl keeps batteries with both a charge_target and a
+	// charge_floor within that band: charging is inhibited through
+	// charge_behaviour at the target and allowed again at the floor, and
+	// set back to auto on shutdown or when control is turned off.
+	// Without charge_behaviour the band is written to the start/end
+	// thresholds instead. Needs write access to sysfs (usually root).
+	ChargeControl bool `yaml:"charge_control"`
+
+	// LowBattery runs Command with sh -c when a discharging battery drops
+	// below Percent, with POWER_EXPORTER_BATTERY and POWER_EXPORTER_PERCENT
+	// in its environment. It fires once per crossing and re-arms when the
+	// battery is back above Percent.
+	LowBattery struct {
+		Percent int    `yaml:"percent"`
+		Command string `yaml:"command"`
+	} `yaml:"low_battery"`
+
+	// LearnedCapacity points at a vendor-specific learned full-charge
+	// capacity log per battery (debugfs or vendor sysfs). The last number
+	// in the file is exported as battery_learned_full_capacity_wh.
+	LearnedCapacity map[string]struct {
+		Path string `yaml:"path"`
+		// Unit of the logged value: uWh (default), mWh or Wh.
+		Unit string `yaml:"unit"`
+	} `yaml:"learned_capacity"`
+
+	// CellVoltages points at a vendor-specific file listing the pack's
+	// individual cell voltages (comma or space separated), exported as
+	// battery_cell_voltage_volts{cell="1"...}.
+	CellVoltages map[string]struct {
+		Path string `yaml:"path"`
+		// Unit of the listed values: uV (default), mV or V.
+		Unit string `yaml:"unit"`
+	} `yaml:"cell_voltages"`
+
+	// ACPICall is last-resort support for firmware that lacks standard
+	// sysfs fields. Method is evaluated through the acpi_call module's
+	// /proc/acpi/call and the returned package elements are mapped, in
+	// order, to the uevent keys in Fields ("" skips an element), times
+	// Scale (default 1000, ACPI mWh/mV to µWh/µV). The values only fill
+	// keys the uevent file lacks. Evaluating the wrong method can hang or
+	// misconfigure the embedded controller.
+	ACPICall map[string]struct {
+		Method string   `yaml:"method"`
+		Fields []string `yaml:"fields"`
+		Scale  int      `yaml:"scale"`
+	} `yaml:"acpi_call"`
+
+	// UeventKeys maps non-standard uevent keys from vendor drivers to a
+	// known BatteryInfo field name or standard POWER_SUPPLY_* key
+	// (e.g. VENDOR_BATT_SOC: Capacity).
+	UeventKeys map[string]string `yaml:"uevent_keys"`
+
+	// CellCount overrides the inferred number of series cells per battery
+	// (e.g. BAT0: 3) used for battery_voltage_per_cell_volts.
+	CellCount map[string]int `yaml:"cell_count"`
+
+	// History keeps the last Depth readings per battery in memory,
+	// served as JSON at /history.
+	History struct {
+		Enabled bool `yaml:"enabled"`
+		Depth   int  `yaml:"depth"`
+	} `yaml:"history"`
+
+	// Errors keeps the last Depth errors from all subsystems in memory,
+	// served as JSON at /errors.
+	Errors struct {
+		Enabled bool `yaml:"enabled"`
+		Depth   int  `yaml:"depth"`
+	} `yaml:"errors"`
+
+	// HealthBaseline exports the minimum capacity health over the trailing
+	// 24 hours, which is steadier than the raw ENERGY_FULL based value.
+	HealthBaseline bool `yaml:"health_baseline"`
+
+	// ThermalThrottle sets the heuristic for battery_charge_thermal_throttled:
+	// the pack is at or above TempCelsius and either not charging, or
+	// charging below MinChargeCurrentMA (0 disables the current check).
+	ThermalThrottle struct {
+		TempCelsius        float64 `yaml:"temp_celsius"`
+		MinChargeCurrentMA int     `yaml:"min_charge_current_ma"`
+	} `yaml:"thermal_throttle"`
+
+	// Powercap exports cpu_power_watts per zone (package, core, uncore,
+	// dram, psys) from /sys/class/powercap energy counters.
+	Powercap bool `yaml:"powercap"`
+
+	// MiscalibrationThreshold is the percentage point gap between the
+	// reported capacity and ENERGY_NOW/ENERGY_FULL above which
+	// battery_gauge_miscalibrated is set (default 10).
+	MiscalibrationThreshold float64 `yaml:"miscalibration_threshold"`
+
+	// LabelBy selects the battery label value: "name" (BAT0, default) or
+	// "serial", which stays stable when names swap between boots. Falls
+	// back to the name for batteries without a serial.
+	LabelBy string `yaml:"label_by"`
+
+	// Locations maps battery names to a human-friendly bay name (e.g.
+	// BAT1: ultrabay), exported as the location label/tag.
+	Locations map[string]string `yaml:"locations"`
+
 	Host string `yaml:"host"`
 }
 
+type ListenerConfig struct {
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+
+	TLS       TLSConfig       `yaml:"tls"`
+	BasicAuth BasicAuthConfig `yaml:"basic_auth"`
+}
+
+// TLSConfig enables HTTPS when both files are set.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// BasicAuthConfig requires HTTP basic auth when Username is set.
+type BasicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"` // bcrypt hash
+}
+
+// validate checks that TLS has both files or neither and that basic auth
+// has a well-formed bcrypt hash.
+func (l ListenerConfig) validate() error {
+	if (l.TLS.CertFile == "") != (l.TLS.KeyFile == "") {
+		return fmt.Errorf("tls needs both cert_file and key_file")
+	}
+	if l.BasicAuth.Username != "" {
+		if _, err := bcrypt.Cost([]byte(l.BasicAuth.Password)); err != nil {
+			return fmt.Errorf("basic_auth password must be a bcrypt hash: %w", err)
+		}
+	}
+	return nil
+}
+
 type BatteryInfo struct {
 	Name         string
 	Status       string
@@ -60,10 +378,142 @@ type BatteryInfo struct {
 	EnergyFull   int
 	EnergyNow    int
 	EnergyDesign int
+	// ChargeNow, ChargeFull and ChargeDesign are in µAh, reported instead
+	// of the ENERGY_* values by charge-based fuel gauges.
+	ChargeNow    int
+	ChargeFull   int
+	ChargeDesign int
 	Capacity     int
 	Model        string
 	Manufacturer string
 	Serial       string
+
+	// ChargeCounter is the fuel gauge's accumulated charge in µAh. It is
+	// signed and may reset or wrap, so treat it as a gauge, not a counter.
+	ChargeCounter    int
+	HasChargeCounter bool
+
+	// VoltageMinDesign and VoltageMaxDesign are the pack's design voltages
+	// in µV, used to infer the number of series cells.
+	VoltageMinDesign int
+	VoltageMaxDesign int
+
+	// VoltageOCV is the open-circuit voltage in µV.
+	VoltageOCV    int
+	HasVoltageOCV bool
+
+	// CapacityErrorMargin is the fuel gauge's ± uncertainty on Capacity,
+	// in percent.
+	CapacityErrorMargin    int
+	HasCapacityErrorMargin bool
+
+	// ChargeEndThreshold and ChargeStartThreshold are
+	// charge_control_end_threshold and charge_control_start_threshold,
+	// sibling files of uevent, in percent.
+	ChargeEndThreshold      int
+	HasChargeEndThreshold   bool
+	ChargeStartThreshold    int
+	HasChargeStartThreshold bool
+
+	// PowerNow is the instantaneous power draw in µW.
+	PowerNow    int
+	HasPowerNow bool
+
+	// Temp is the pack temperature in tenths of a degree Celsius.
+	Temp    int
+	HasTemp bool
+
+	// CurrentNow is the instantaneous current in µA. Its sign convention
+	// varies between drivers.
+	CurrentNow    int
+	HasCurrentNow bool
+
+	// LearnedFullWh is the latest learned full-charge capacity from the
+	// learned_capacity log, in Wh.
+	LearnedFullWh  float64
+	HasLearnedFull bool
+
+	// CellVoltages are the individual cell voltages in volts from the
+	// cell_voltages file; nil when not configured.
+	CellVoltages []float64
+
+	// CapacityLevel is POWER_SUPPLY_CAPACITY_LEVEL (Full, High, Normal,
+	// Low, Critical or Unknown), reported by drivers without a precise
+	// percentage.
+	CapacityLevel string
+
+	// Scope is POWER_SUPPLY_SCOPE: "System", "Device" for peripherals
+	// such as wireless mice, or empty when the driver does not say.
+	Scope string
+}
+
+type AdapterInfo struct {
+	Name   string
+	Type   string
+	Online bool
+
+	// VoltageMax (µV) and CurrentMax (µA) are the adapter's advertised
+	// capabilities, exposed by typec/ucsi power supplies.
+	VoltageMax    int
+	HasVoltageMax bool
+	CurrentMax    int
+	HasCurrentMax bool
+
+	// Present input readings (µW, µV, µA), where the adapter reports them.
+	PowerNow      int
+	HasPowerNow   bool
+	VoltageNow    int
+	CurrentNow    int
+	HasCurrentNow bool
+}
+
+// inputPower returns the adapter's input power in watts, if it is online
+// and reports enough to compute it.
+func (a *AdapterInfo) inputPower() (float64, bool) {
+	if !a.Online {
+		return 0, false
+	}
+	if a.HasPowerNow {
+		return float64(a.PowerNow) / 1000000.0, true
+	}
+	if a.HasCurrentNow && a.VoltageNow > 0 {
+		return math.Abs(float64(a.CurrentNow)) * float64(a.VoltageNow) / 1e12, true
+	}
+	return 0, false
+}
+
+// batteryState holds per-battery values carried across polling cycles.
+type batteryState struct {
+	lastSample      time.Time
+	lastEnergyNow   int
+	energySinceFull float64 // Wh discharged since the last Full status
+
+	designOverrideLogged bool
+
+	// Hourly minimum health for the trailing 24h baseline, indexed by
+	// hour-of-epoch modulo 24.
+	healthMin  [24]float64
+	healthHour [24]int64
+
+	lastStatusSample time.Time
+	stale            bool
+
+	readFailures int // consecutive failed reads
+
+	samples int // successful reads since start
+
+	// infoLabels and levelLabels are the label values last set on
+	// battery_info and battery_capacity_level_info.
+	infoLabels  []string
+	levelLabels []string
+
+	// chargeInhibited is set while charge_control keeps charge_behaviour
+	// at inhibit-charge, so it can be set back to auto on shutdown.
+	chargeInhibited bool
+
+	// lowBatteryArmed is set once the battery was seen above
+	// low_battery.percent, so the hook only fires on the way down.
+	lowBatteryArmed bool
 }
 
 var (
@@ -72,7 +522,73 @@ var (
 
 	config     Config
 	batteries  []string
-	promGauges = make(map[string]map[string]*prometheus.GaugeVec)
+	lastRescan time.Time
+	// batteryGauges are shared by all batteries, which differ only in
+	// their label values, so batteries can come and go at runtime.
+	batteryGauges map[string]*prometheus.GaugeVec
+	batStates     = make(map[string]*batteryState)
+
+	// readTimes records when each battery was last read successfully and
+	// batteryIDs the battery label value last used for it (see label_by).
+	// Both are keyed by battery name.
+	readTimes   = make(map[string]time.Time)
+	batteryIDs  = make(map[string]string)
+	readTimesMu sync.Mutex
+	// adapterReadTime is when an adapter was last read successfully and
+	// batteryCount how many batteries the last cycle polled, for /readyz
+	// on adapter-only hosts. Also guarded by readTimesMu.
+	adapterReadTime time.Time
+	batteryCount    int
+
+	history   = make(map[string][]historyEntry)
+	historyMu sync.Mutex
+
+	recentErrors   []errorEntry
+	recentErrorsMu sync.Mutex
+	// errorSettings is the part of the config logError needs, guarded by
+	// recentErrorsMu: logError runs from client callbacks that do not hold
+	// configMu, and from code that already holds it.
+	errorSettings struct {
+		enabled bool
+		depth   int
+		secrets []string
+	}
+
+	adapters      []string
+	adapterOnline = make(map[string]bool)
+	promCounters  = make(map[string]*prometheus.CounterVec)
+	adapterGauges = make(map[string]*prometheus.GaugeVec)
+	systemGauges  = make(map[string]prometheus.Gauge)
+	promHists     = make(map[string]*prometheus.HistogramVec)
+
+	powercapGauge   *prometheus.GaugeVec
+	powercapSamples = make(map[string]powercapSample)
+	powercapDenied  = make(map[string]bool)
+	scrapeSuccess   *prometheus.GaugeVec
+
+	// configMu guards config against a SIGHUP reload. Polling cycles,
+	// HTTP requests and backend retries hold the read lock.
+	configMu sync.RWMutex
+
+	// configMtime is the modification time of the config file as of the
+	// last (re)load; configReloads counts successful reloads.
+	configMtime      time.Time
+	configMtimeGauge prometheus.GaugeFunc
+	configReloads    prometheus.Counter
+
+	batteryLabels = []string{"battery", "location"}
+
+	// tracing logs raw uevent lines, parsed values and computed metrics
+	// for the first polling cycle (-trace). traceRedact hides serials.
+	tracing     bool
+	traceRedact bool
+
+	// readOnly is set for -status and -tail, which only print readings
+	// and must not change sysfs (charge_control) or run low_battery.
+	readOnly bool
+
+	// ueventAliases is config.UeventKeys resolved to standard keys.
+	ueventAliases map[string]string
 
 	repoOwner = "coolerUA"
 	repoName  = "power-exporter"
@@ -209,278 +725,4270 @@ func loadConfig(path string) error {
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(data, &config)
-}
+	if fi, err := os.Stat(path); err == nil {
+		configMtime = fi.ModTime()
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
 
-func findBatteries() []string {
-	var result []string
-	entries, err := os.ReadDir("/sys/class/power_supply")
-	if err != nil {
-		log.Printf("Error reading power_supply: %v", err)
-		return result
+	if err := validateInterval(); err != nil {
+		return err
 	}
-	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), "BAT") {
-			ueventPath := filepath.Join("/sys/class/power_supply", e.Name(), "uevent")
-			if _, err := os.Stat(ueventPath); err == nil {
-				result = append(result, e.Name())
-			}
+
+	if config.Prometheus.Path == "" {
+		config.Prometheus.Path = "/metrics"
+	}
+	if config.Prometheus.Path, err = normalizeHTTPPath(config.Prometheus.Path); err != nil {
+		return fmt.Errorf("invalid prometheus.path: %w", err)
+	}
+	if config.Prometheus.Path == "/" {
+		return fmt.Errorf("invalid prometheus.path: must not be the root path")
+	}
+	switch config.Prometheus.Path {
+	case "/healthz", "/readyz", "/history", "/errors":
+		return fmt.Errorf("invalid prometheus.path: %s is reserved", config.Prometheus.Path)
+	}
+	if config.Prometheus.BasePath != "" {
+		if config.Prometheus.BasePath, err = normalizeHTTPPath(config.Prometheus.BasePath); err != nil {
+			return fmt.Errorf("invalid prometheus.base_path: %w", err)
 		}
+		config.Prometheus.BasePath = strings.TrimSuffix(config.Prometheus.BasePath, "/")
 	}
-	return result
-}
 
-func readBatteryInfo(name string) (*BatteryInfo, error) {
-	path := filepath.Join("/sys/class/power_supply", name, "uevent")
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	if err := defaultListener().validate(); err != nil {
+		return fmt.Errorf("invalid prometheus config: %w", err)
+	}
+	for i, l := range config.Prometheus.Listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("invalid prometheus.listeners[%d]: %w", i, err)
+		}
 	}
-	defer file.Close()
 
-	info := &BatteryInfo{Name: name}
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
+	switch config.LabelBy {
+	case "", "name", "serial":
+	default:
+		return fmt.Errorf("invalid label_by %q: want name or serial", config.LabelBy)
+	}
+
+	for name, lc := range config.LearnedCapacity {
+		if lc.Path == "" {
+			return fmt.Errorf("learned_capacity %s: path is required", name)
 		}
-		key, val := parts[0], parts[1]
-		switch key {
-		case "POWER_SUPPLY_STATUS":
-			info.Status = val
-		case "POWER_SUPPLY_PRESENT":
-			info.Present = val == "1"
-		case "POWER_SUPPLY_TECHNOLOGY":
-			info.Technology = val
-		case "POWER_SUPPLY_CYCLE_COUNT":
-			info.CycleCount, _ = strconv.Atoi(val)
-		case "POWER_SUPPLY_VOLTAGE_NOW":
-			info.VoltageNow, _ = strconv.Atoi(val)
-		case "POWER_SUPPLY_ENERGY_FULL_DESIGN":
-			info.EnergyDesign, _ = strconv.Atoi(val)
-		case "POWER_SUPPLY_ENERGY_FULL":
-			info.EnergyFull, _ = strconv.Atoi(val)
-		case "POWER_SUPPLY_ENERGY_NOW":
-			info.EnergyNow, _ = strconv.Atoi(val)
-		case "POWER_SUPPLY_CAPACITY":
-			info.Capacity, _ = strconv.Atoi(val)
-		case "POWER_SUPPLY_MODEL_NAME":
-			info.Model = val
-		case "POWER_SUPPLY_MANUFACTURER":
-			info.Manufacturer = val
-		case "POWER_SUPPLY_SERIAL_NUMBER":
-			info.Serial = val
+		if _, ok := learnedCapacityUnits[lc.Unit]; !ok {
+			return fmt.Errorf("invalid learned_capacity %s unit %q: want uWh, mWh or Wh", name, lc.Unit)
 		}
 	}
-	return info, nil
-}
 
-func initPrometheusMetrics() {
-	for _, bat := range batteries {
-		promGauges[bat] = map[string]*prometheus.GaugeVec{
-			"percentage": prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: "battery_percentage",
-				Help: "Battery charge percentage",
-			}, []string{"battery"}),
-			"capacity": prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: "battery_capacity_percent",
-				Help: "Battery health/capacity compared to design",
-			}, []string{"battery"}),
-			"charging": prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: "battery_charging",
-				Help: "1 if charging, 0 if discharging, 2 if full",
-			}, []string{"battery"}),
-			"voltage": prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: "battery_voltage_volts",
-				Help: "Current battery voltage in volts",
-			}, []string{"battery"}),
-			"energy_now": prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: "battery_energy_wh",
-				Help: "Current energy in Wh",
-			}, []string{"battery"}),
-			"cycle_count": prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Name: "battery_cycle_count",
-				Help: "Battery cycle count",
-			}, []string{"battery"}),
-		}
-	}
-	// Register only once (first battery's gauges are shared)
-	if len(batteries) > 0 {
-		bat := batteries[0]
-		for _, g := range promGauges[bat] {
-			prometheus.MustRegister(g)
+	for name, floor := range config.ChargeFloor {
+		target, ok := config.ChargeTarget[name]
+		if !ok {
+			return fmt.Errorf("charge_floor %s: needs a charge_target", name)
+		}
+		if floor < 0 || target > 100 || floor >= target {
+			return fmt.Errorf("charge_floor %s: want 0 <= floor (%d) < target (%d) <= 100", name, floor, target)
 		}
 	}
-}
 
-func updateMetrics() {
-	interval := time.Duration(config.Interval) * time.Second
-	if interval == 0 {
-		interval = 10 * time.Second
+	if config.LowBattery.Command != "" && (config.LowBattery.Percent <= 0 || config.LowBattery.Percent > 100) {
+		return fmt.Errorf("invalid low_battery percent %d: want 1-100", config.LowBattery.Percent)
 	}
 
-	var influxClient influxdb2.Client
-	var influxWriteAPI api.WriteAPI
-	if config.InfluxDB.Enabled {
-		influxClient = influxdb2.NewClient(config.InfluxDB.URL, config.InfluxDB.Token)
-		influxWriteAPI = influxClient.WriteAPI(config.InfluxDB.Org, config.InfluxDB.Bucket)
+	for name, cv := range config.CellVoltages {
+		if cv.Path == "" {
+			return fmt.Errorf("cell_voltages %s: path is required", name)
+		}
+		if _, ok := cellVoltageUnits[cv.Unit]; !ok {
+			return fmt.Errorf("invalid cell_voltages %s unit %q: want uV, mV or V", name, cv.Unit)
+		}
 	}
 
-	for {
-		for _, batName := range batteries {
-			info, err := readBatteryInfo(batName)
-			if err != nil {
-				log.Printf("Error reading %s: %v", batName, err)
-				continue
-			}
+	switch config.InfluxDB.Version {
+	case 0, 1, 2:
+	default:
+		return fmt.Errorf("invalid influxdb version %d: want 1 or 2", config.InfluxDB.Version)
+	}
 
-			percentage := float64(info.Capacity)
-			capacityHealth := 100.0
-			if info.EnergyDesign > 0 {
-				capacityHealth = 100.0 * float64(info.EnergyFull) / float64(info.EnergyDesign)
-			}
-			// Status: 0=Discharging, 1=Charging, 2=Full, 3=Not charging
-			charging := 0.0
-			switch info.Status {
-			case "Charging":
-				charging = 1.0
-			case "Full":
-				charging = 2.0
-			case "Not charging":
-				charging = 3.0
-			}
-			voltage := float64(info.VoltageNow) / 1000000.0
-			energyWh := float64(info.EnergyNow) / 1000000.0
+	switch write.Consistency(config.InfluxDB.Consistency) {
+	case "", write.ConsistencyAny, write.ConsistencyOne, write.ConsistencyQuorum, write.ConsistencyAll:
+	default:
+		return fmt.Errorf("invalid influxdb consistency %q: want any, one, quorum or all", config.InfluxDB.Consistency)
+	}
 
-			// Prometheus metrics (for both scrape and push)
-			if config.Prometheus.Enabled || config.Pushgateway.Enabled {
-				g := promGauges[batteries[0]]
-				g["percentage"].WithLabelValues(batName).Set(percentage)
-				g["capacity"].WithLabelValues(batName).Set(capacityHealth)
-				g["charging"].WithLabelValues(batName).Set(charging)
-				g["voltage"].WithLabelValues(batName).Set(voltage)
-				g["energy_now"].WithLabelValues(batName).Set(energyWh)
-				g["cycle_count"].WithLabelValues(batName).Set(float64(info.CycleCount))
-			}
+	switch config.Source {
+	case "", "sysfs", "upower":
+	default:
+		return fmt.Errorf("invalid source %q: want sysfs or upower", config.Source)
+	}
 
-			// InfluxDB
-			if config.InfluxDB.Enabled && influxWriteAPI != nil {
-				p := influxdb2.NewPoint(
-					"battery",
-					map[string]string{
-						"host":    config.Host,
-						"battery": batName,
-					},
-					map[string]interface{}{
-						"percentage":      percentage,
-						"capacity_health": capacityHealth,
-						"charging":        charging,
-						"voltage":         voltage,
-						"energy_wh":       energyWh,
-						"cycle_count":     info.CycleCount,
-						"status":          info.Status,
-					},
-					time.Now())
-				influxWriteAPI.WritePoint(p)
-			}
-		}
+	switch config.BackendInit {
+	case "", "fatal", "warn", "retry":
+	default:
+		return fmt.Errorf("invalid backend_init %q: want fatal, warn or retry", config.BackendInit)
+	}
 
-		if config.InfluxDB.Enabled && influxWriteAPI != nil {
-			influxWriteAPI.Flush()
+	targets := make(map[string]string)
+	for from, to := range config.InfluxDB.FieldMap {
+		if to == "" {
+			return fmt.Errorf("invalid influxdb.field_map entry %s: empty name", from)
 		}
+		if other, ok := targets[to]; ok {
+			return fmt.Errorf("invalid influxdb.field_map: %s and %s both map to %q", other, from, to)
+		}
+		targets[to] = from
+		// A field keeps its name unless it is renamed itself
+		if _, renamed := config.InfluxDB.FieldMap[to]; !renamed && (slices.Contains(batteryFieldNames, to) || cellVoltageField.MatchString(to)) {
+			return fmt.Errorf("invalid influxdb.field_map entry %s: %q is already a field", from, to)
+		}
+	}
 
-		// Pushgateway
-		if config.Pushgateway.Enabled {
-			job := config.Pushgateway.Job
-			if job == "" {
-				job = "power_exporter"
-			}
-			pusher := push.New(config.Pushgateway.URL, job).
-				Grouping("host", config.Host)
-			for _, g := range promGauges[batteries[0]] {
-				pusher = pusher.Collector(g)
-			}
-			if err := pusher.Push(); err != nil {
-				log.Printf("Pushgateway error: %v", err)
+	ueventAliases = make(map[string]string)
+	for vendorKey, target := range config.UeventKeys {
+		key, ok := ueventFieldKeys[target]
+		if !ok {
+			if !strings.HasPrefix(target, "POWER_SUPPLY_") {
+				return fmt.Errorf("invalid uevent_keys entry %s: unknown field %q", vendorKey, target)
 			}
+			key = target
 		}
+		ueventAliases[vendorKey] = key
+	}
+	updateErrorSettings()
+	return nil
+}
 
-		time.Sleep(interval)
+// ueventFieldKeys maps BatteryInfo field names to the uevent keys they are
+// parsed from, so uevent_keys can refer to fields by name.
+var ueventFieldKeys = map[string]string{
+	"Status":              "POWER_SUPPLY_STATUS",
+	"Present":             "POWER_SUPPLY_PRESENT",
+	"Technology":          "POWER_SUPPLY_TECHNOLOGY",
+	"CycleCount":          "POWER_SUPPLY_CYCLE_COUNT",
+	"VoltageNow":          "POWER_SUPPLY_VOLTAGE_NOW",
+	"VoltageMinDesign":    "POWER_SUPPLY_VOLTAGE_MIN_DESIGN",
+	"VoltageMaxDesign":    "POWER_SUPPLY_VOLTAGE_MAX_DESIGN",
+	"VoltageOCV":          "POWER_SUPPLY_VOLTAGE_OCV",
+	"EnergyDesign":        "POWER_SUPPLY_ENERGY_FULL_DESIGN",
+	"EnergyFull":          "POWER_SUPPLY_ENERGY_FULL",
+	"EnergyNow":           "POWER_SUPPLY_ENERGY_NOW",
+	"ChargeDesign":        "POWER_SUPPLY_CHARGE_FULL_DESIGN",
+	"ChargeFull":          "POWER_SUPPLY_CHARGE_FULL",
+	"ChargeNow":           "POWER_SUPPLY_CHARGE_NOW",
+	"Capacity":            "POWER_SUPPLY_CAPACITY",
+	"CapacityErrorMargin": "POWER_SUPPLY_CAPACITY_ERROR_MARGIN",
+	"PowerNow":            "POWER_SUPPLY_POWER_NOW",
+	"CurrentNow":          "POWER_SUPPLY_CURRENT_NOW",
+	"Temp":                "POWER_SUPPLY_TEMP",
+	"ChargeCounter":       "POWER_SUPPLY_CHARGE_COUNTER",
+	"Model":               "POWER_SUPPLY_MODEL_NAME",
+	"Manufacturer":        "POWER_SUPPLY_MANUFACTURER",
+	"Serial":              "POWER_SUPPLY_SERIAL_NUMBER",
+}
+
+// validateInterval rejects negative intervals and warns about unset or
+// very short ones.
+func validateInterval() error {
+	if config.Interval < 0 {
+		return fmt.Errorf("invalid interval %v: must not be negative", config.Interval)
+	}
+	if config.MinInterval < 0 {
+		return fmt.Errorf("invalid min_interval %v: must not be negative", config.MinInterval)
+	}
+	if config.Interval == 0 {
+		log.Printf("interval not set, using the default of %s", pollInterval())
+		return nil
+	}
+	floor := config.MinInterval
+	if floor == 0 {
+		floor = 1
 	}
+	if config.Interval < floor {
+		log.Printf("Warning: interval %vs is below %vs; frequent polling keeps the embedded controller busy and costs battery", config.Interval, floor)
+	}
+	return nil
 }
 
-const defaultConfig = `# Power Exporter Configuration
+// normalizeHTTPPath ensures p starts with a slash and rejects values that
+// http.ServeMux would not match the way the user expects.
+func normalizeHTTPPath(p string) (string, error) {
+	if strings.ContainsAny(p, " \t\r\n") {
+		return "", fmt.Errorf("%q contains whitespace", p)
+	}
+	if strings.ContainsAny(p, "?#") {
+		return "", fmt.Errorf("%q must not contain a query or fragment", p)
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p, nil
+}
 
-# Polling interval in seconds
-interval: 10
+// powerSupplyPath joins elem onto sysfs_path.
+func powerSupplyPath(elem ...string) string {
+	root := config.SysfsPath
+	if root == "" {
+		root = "/sys/class/power_supply"
+	}
+	return filepath.Join(append([]string{root}, elem...)...)
+}
 
-# Hostname for metrics tagging
-host: "myhost"
+// powercapPath returns the powercap class directory next to sysfs_path.
+func powercapPath() string {
+	return filepath.Join(filepath.Dir(powerSupplyPath()), "powercap")
+}
 
-# Prometheus metrics server (scrape endpoint)
-prometheus:
-  enabled: true
-  port: 9273
-  path: "/metrics"
+func findBatteries() []string {
+	if config.Source == "upower" {
+		return findUPowerBatteries()
+	}
+	var result []string
+	entries, err := os.ReadDir(powerSupplyPath())
+	if err != nil {
+		log.Printf("Error reading power_supply: %v", err)
+		return result
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "BAT") {
+			ueventPath := powerSupplyPath(e.Name(), "uevent")
+			if _, err := os.Stat(ueventPath); err == nil {
+				result = append(result, e.Name())
+			}
+		}
+	}
+	return result
+}
 
-# Prometheus Pushgateway
-pushgateway:
-  enabled: false
-  url: "http://localhost:9091"
-  job: "power_exporter"
+const (
+	upowerService   = "org.freedesktop.UPower"
+	upowerPath      = "/org/freedesktop/UPower"
+	upowerDeviceIfc = "org.freedesktop.UPower.Device"
 
-# InfluxDB push
-influxdb:
-  enabled: false
-  url: "http://localhost:8086"
-  token: "your-token"
-  org: "your-org"
-  bucket: "your-bucket"
-`
+	upowerTypeLinePower = 1
+)
 
-const systemdUnitTemplate = `[Unit]
-Description=Power Exporter - Exports power/energy metrics to Prometheus
-Documentation=https://github.com/coolerUA/power-exporter
-After=network-online.target
-Wants=network-online.target
+// upowerDevices maps battery names (the basename of NativePath, e.g. BAT0
+// or hidpp_battery_0) to their UPower object paths.
+var upowerDevices = make(map[string]dbus.ObjectPath)
 
-[Service]
-Type=simple
-ExecStart=%s -c %s
-Restart=always
-RestartSec=5
+// upowerBus is the part of the UPower D-Bus API the upower source uses.
+type upowerBus interface {
+	// EnumerateDevices returns the object paths of all UPower devices.
+	EnumerateDevices() ([]dbus.ObjectPath, error)
+	// DeviceProperties returns the org.freedesktop.UPower.Device
+	// properties of one device.
+	DeviceProperties(path dbus.ObjectPath) (map[string]dbus.Variant, error)
+}
 
-[Install]
-WantedBy=multi-user.target
-`
+// systemUPower is UPower on the D-Bus system bus.
+type systemUPower struct {
+	conn *dbus.Conn
+}
 
-func installSystemd(binPath, configPath string) error {
-	// Get current executable
-	exe, err := os.Executable()
+func (u systemUPower) EnumerateDevices() ([]dbus.ObjectPath, error) {
+	var paths []dbus.ObjectPath
+	err := u.conn.Object(upowerService, upowerPath).Call(upowerService+".EnumerateDevices", 0).Store(&paths)
+	return paths, err
+}
+
+func (u systemUPower) DeviceProperties(path dbus.ObjectPath) (map[string]dbus.Variant, error) {
+	var props map[string]dbus.Variant
+	err := u.conn.Object(upowerService, path).
+		Call("org.freedesktop.DBus.Properties.GetAll", 0, upowerDeviceIfc).
+		Store(&props)
+	return props, err
+}
+
+// connectUPower returns the UPower service to read from. Tests replace it
+// with a fake.
+var connectUPower = func() (upowerBus, error) {
+	conn, err := dbus.SystemBus()
 	if err != nil {
-		return fmt.Errorf("failed to get executable path: %w", err)
+		return nil, err
 	}
+	return systemUPower{conn}, nil
+}
 
-	// Copy binary to destination
-	binData, err := os.ReadFile(exe)
+// findUPowerBatteries lists every UPower device that is not line power,
+// which covers system batteries as well as peripherals like mice.
+func findUPowerBatteries() []string {
+	bus, err := connectUPower()
 	if err != nil {
-		return fmt.Errorf("failed to read binary: %w", err)
+		log.Printf("Error connecting to system bus: %v", err)
+		return nil
 	}
-	if err := os.WriteFile(binPath, binData, 0755); err != nil {
-		return fmt.Errorf("failed to write binary to %s: %w", binPath, err)
+	paths, err := bus.EnumerateDevices()
+	if err != nil {
+		log.Printf("Error enumerating UPower devices: %v", err)
+		return nil
 	}
-	fmt.Printf("Binary installed to %s\n", binPath)
 
-	// Generate config if not exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		if err := os.WriteFile(configPath, []byte(defaultConfig), 0644); err != nil {
-			return fmt.Errorf("failed to write config: %w", err)
+	var result []string
+	for _, p := range paths {
+		props, err := bus.DeviceProperties(p)
+		if err != nil {
+			continue
 		}
-		fmt.Printf("Config created at %s\n", configPath)
-	} else {
-		fmt.Printf("Config already exists at %s\n", configPath)
+		if t, _ := props["Type"].Value().(uint32); t == upowerTypeLinePower {
+			continue
+		}
+		name := string(p)
+		if s, _ := props["NativePath"].Value().(string); s != "" {
+			name = filepath.Base(s)
+		}
+		upowerDevices[name] = p
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// upowerStates maps the UPower State enum to sysfs-style status strings.
+var upowerStates = map[uint32]string{
+	1: "Charging",
+	2: "Discharging",
+	3: "Discharging", // empty
+	4: "Full",
+	5: "Not charging", // pending charge
+	6: "Discharging",  // pending discharge
+}
+
+// upowerTechnologies maps the UPower Technology enum to sysfs names.
+var upowerTechnologies = map[uint32]string{
+	1: "Li-ion",
+	2: "Li-poly",
+	3: "LiFe",
+	4: "Lead acid",
+	5: "NiCd",
+	6: "NiMH",
+}
+
+// readUPowerBatteryInfo fills a BatteryInfo from UPower device properties,
+// converting to the same µ-units sysfs uses.
+func readUPowerBatteryInfo(name string) (*BatteryInfo, error) {
+	path, ok := upowerDevices[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown UPower device %s", name)
+	}
+	bus, err := connectUPower()
+	if err != nil {
+		return nil, err
+	}
+	props, err := bus.DeviceProperties(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f64 := func(key string) float64 {
+		v, _ := props[key].Value().(float64)
+		return v
+	}
+	str := func(key string) string {
+		v, _ := props[key].Value().(string)
+		return v
+	}
+	u32 := func(key string) uint32 {
+		v, _ := props[key].Value().(uint32)
+		return v
+	}
+
+	info := &BatteryInfo{
+		Name:         name,
+		Status:       upowerStates[u32("State")],
+		Technology:   upowerTechnologies[u32("Technology")],
+		Capacity:     int(math.Round(f64("Percentage"))),
+		VoltageNow:   int(f64("Voltage") * 1000000.0),
+		EnergyNow:    int(f64("Energy") * 1000000.0),
+		EnergyFull:   int(f64("EnergyFull") * 1000000.0),
+		EnergyDesign: int(f64("EnergyFullDesign") * 1000000.0),
+		Model:        str("Model"),
+		Manufacturer: str("Vendor"),
+		Serial:       str("Serial"),
+	}
+	info.Present, _ = props["IsPresent"].Value().(bool)
+	// PowerSupply is false for peripherals such as mice and headsets
+	if ps, ok := props["PowerSupply"].Value().(bool); ok {
+		info.Scope = "System"
+		if !ps {
+			info.Scope = "Device"
+		}
+	}
+	if cycles, ok := props["ChargeCycles"].Value().(int32); ok && cycles >= 0 {
+		info.CycleCount = int(cycles)
+	}
+	if rate, ok := props["EnergyRate"]; ok {
+		v, _ := rate.Value().(float64)
+		info.PowerNow = int(v * 1000000.0)
+		info.HasPowerNow = true
+	}
+	if temp := f64("Temperature"); temp != 0 {
+		info.Temp = int(temp * 10)
+		info.HasTemp = true
+	}
+	return info, nil
+}
+
+// waitForBatteries polls findBatteries until at least one battery shows up
+// or maxWait has elapsed.
+func waitForBatteries(maxWait time.Duration) []string {
+	deadline := time.Now().Add(maxWait)
+	for {
+		found := findBatteries()
+		if len(found) > 0 || !time.Now().Before(deadline) {
+			return found
+		}
+		log.Printf("No batteries found yet, retrying (up to %s)", time.Until(deadline).Round(time.Second))
+		time.Sleep(time.Second)
+	}
+}
+
+// findAdapters returns the mains and USB (typec/ucsi) power supplies.
+func findAdapters() []string {
+	var result []string
+	entries, err := os.ReadDir(powerSupplyPath())
+	if err != nil {
+		return result
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "BAT") {
+			continue
+		}
+		info, err := readAdapterInfo(e.Name())
+		if err != nil {
+			continue
+		}
+		if info.Type == "Mains" || info.Type == "USB" {
+			result = append(result, e.Name())
+		}
+	}
+	return result
+}
+
+func readAdapterInfo(name string) (*AdapterInfo, error) {
+	path := powerSupplyPath(name, "uevent")
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := &AdapterInfo{Name: name}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "POWER_SUPPLY_TYPE":
+			info.Type = parts[1]
+		case "POWER_SUPPLY_ONLINE":
+			info.Online = parts[1] == "1"
+		case "POWER_SUPPLY_VOLTAGE_MAX":
+			if v, err := strconv.Atoi(parts[1]); err == nil {
+				info.VoltageMax = v
+				info.HasVoltageMax = true
+			}
+		case "POWER_SUPPLY_CURRENT_MAX":
+			if v, err := strconv.Atoi(parts[1]); err == nil {
+				info.CurrentMax = v
+				info.HasCurrentMax = true
+			}
+		case "POWER_SUPPLY_POWER_NOW":
+			if v, err := strconv.Atoi(parts[1]); err == nil {
+				info.PowerNow = v
+				info.HasPowerNow = true
+			}
+		case "POWER_SUPPLY_VOLTAGE_NOW":
+			info.VoltageNow, _ = strconv.Atoi(parts[1])
+		case "POWER_SUPPLY_CURRENT_NOW":
+			if v, err := strconv.Atoi(parts[1]); err == nil {
+				info.CurrentNow = v
+				info.HasCurrentNow = true
+			}
+		}
+	}
+	return info, nil
+}
+
+func readBatteryInfo(name string) (*BatteryInfo, error) {
+	if config.Source == "upower" {
+		return readUPowerBatteryInfo(name)
+	}
+	path := powerSupplyPath(name, "uevent")
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := &BatteryInfo{Name: name}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, val := parts[0], parts[1]
+		if tracing {
+			if traceRedact && key == "POWER_SUPPLY_SERIAL_NUMBER" {
+				line = key + "=<redacted>"
+			}
+			log.Printf("trace: %s uevent: %s", name, line)
+		}
+		if alias, ok := ueventAliases[key]; ok {
+			key = alias
+		}
+		seen[key] = true
+		applyUeventKey(info, key, val)
+	}
+
+	if ac, ok := config.ACPICall[name]; ok {
+		values, err := acpiCall(ac.Method)
+		if err != nil {
+			logError("read", "acpi_call for %s: %v", name, err)
+		}
+		scale := ac.Scale
+		if scale == 0 {
+			scale = 1000
+		}
+		for i, key := range ac.Fields {
+			if key == "" || i >= len(values) || seen[key] {
+				continue
+			}
+			if key == "POWER_SUPPLY_STATUS" {
+				applyUeventKey(info, key, acpiBatteryState(values[i]))
+				continue
+			}
+			applyUeventKey(info, key, strconv.FormatInt(values[i]*int64(scale), 10))
+		}
+	}
+
+	// Charge thresholds live outside uevent and are absent on most hardware
+	info.ChargeEndThreshold, info.HasChargeEndThreshold = readSysfsInt(name, "charge_control_end_threshold")
+	info.ChargeStartThreshold, info.HasChargeStartThreshold = readSysfsInt(name, "charge_control_start_threshold")
+
+	if lc, ok := config.LearnedCapacity[name]; ok {
+		if wh, err := readLearnedCapacity(lc.Path, learnedCapacityUnits[lc.Unit]); err != nil {
+			logError("read", "Learned capacity for %s: %v", name, err)
+		} else {
+			info.LearnedFullWh = wh
+			info.HasLearnedFull = true
+		}
+	}
+	if cv, ok := config.CellVoltages[name]; ok {
+		if volts, err := readCellVoltages(cv.Path, cellVoltageUnits[cv.Unit]); err != nil {
+			logError("read", "Cell voltages for %s: %v", name, err)
+		} else {
+			info.CellVoltages = volts
+		}
+	}
+	return info, nil
+}
+
+// cellVoltageUnits maps cell_voltages units to their size in volts.
+var cellVoltageUnits = map[string]float64{
+	"":   1e-6,
+	"uV": 1e-6,
+	"mV": 1e-3,
+	"V":  1,
+}
+
+// readCellVoltages parses a comma, space or newline separated list of
+// cell voltages and returns them in volts, first cell first.
+func readCellVoltages(path string, scale float64) ([]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	var volts []float64
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: invalid value %q", path, f)
+		}
+		volts = append(volts, v*scale)
+	}
+	if len(volts) == 0 {
+		return nil, fmt.Errorf("no values in %s", path)
+	}
+	return volts, nil
+}
+
+// learnedCapacityUnits maps learned_capacity units to their size in Wh.
+var learnedCapacityUnits = map[string]float64{
+	"":    1e-6,
+	"uWh": 1e-6,
+	"mWh": 1e-3,
+	"Wh":  1,
+}
+
+// readLearnedCapacity returns the most recent value of a learned capacity
+// log in Wh: the last number on the last non-empty line. This copes with
+// both single-value files and logs of "timestamp value" lines.
+func readLearnedCapacity(path string, scale float64) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	fields := strings.FieldsFunc(lines[len(lines)-1], func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == ';' || r == '='
+	})
+	for i := len(fields) - 1; i >= 0; i-- {
+		if v, err := strconv.ParseFloat(fields[i], 64); err == nil && v > 0 {
+			return v * scale, nil
+		}
+	}
+	return 0, fmt.Errorf("no value found in %s", path)
+}
+
+// acpiCallPath is the acpi_call module's interface file.
+const acpiCallPath = "/proc/acpi/call"
+
+// acpiCallMu serializes calls, since the result of a write is read back
+// from the same global file.
+var acpiCallMu sync.Mutex
+
+// acpiCall evaluates an ACPI method through acpi_call and parses the
+// result, either an integer or a flat package like {0x1, 0x0, 0x11d0}.
+// Tests replace it with a fake.
+var acpiCall = func(method string) ([]int64, error) {
+	acpiCallMu.Lock()
+	defer acpiCallMu.Unlock()
+	if err := os.WriteFile(acpiCallPath, []byte(method), 0); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(acpiCallPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseACPICallResult(strings.TrimRight(string(data), "\x00\n"))
+}
+
+func parseACPICallResult(s string) ([]int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "Error") || s == "not called" {
+		return nil, fmt.Errorf("%s", s)
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	var values []int64
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseInt(strings.TrimSpace(part), 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected acpi_call result %q", s)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// acpiBatteryState translates the _BST state bits to a uevent status.
+func acpiBatteryState(state int64) string {
+	switch {
+	case state&0x2 != 0:
+		return "Charging"
+	case state&0x1 != 0:
+		return "Discharging"
+	default:
+		return "Not charging"
+	}
+}
+
+// capacityBand maps POWER_SUPPLY_CAPACITY_LEVEL to a number for alerting
+// and graphing. High shares the Normal band.
+func capacityBand(level string) float64 {
+	switch level {
+	case "Full":
+		return 4
+	case "High", "Normal":
+		return 3
+	case "Low":
+		return 2
+	case "Critical":
+		return 1
+	}
+	return 0
+}
+
+// applyUeventKey sets the BatteryInfo field for a standard uevent key.
+func applyUeventKey(info *BatteryInfo, key, val string) {
+	switch key {
+	case "POWER_SUPPLY_STATUS":
+		info.Status = val
+	case "POWER_SUPPLY_PRESENT":
+		info.Present = val == "1"
+	case "POWER_SUPPLY_TECHNOLOGY":
+		info.Technology = val
+	case "POWER_SUPPLY_CYCLE_COUNT":
+		info.CycleCount, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_VOLTAGE_NOW":
+		info.VoltageNow, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_VOLTAGE_MIN_DESIGN":
+		info.VoltageMinDesign, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_VOLTAGE_MAX_DESIGN":
+		info.VoltageMaxDesign, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_VOLTAGE_OCV":
+		if v, err := strconv.Atoi(val); err == nil {
+			info.VoltageOCV = v
+			info.HasVoltageOCV = true
+		}
+	case "POWER_SUPPLY_ENERGY_FULL_DESIGN":
+		info.EnergyDesign, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_ENERGY_FULL":
+		info.EnergyFull, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_ENERGY_NOW":
+		info.EnergyNow, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_CHARGE_FULL_DESIGN":
+		info.ChargeDesign, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_CHARGE_FULL":
+		info.ChargeFull, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_CHARGE_NOW":
+		info.ChargeNow, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_CAPACITY":
+		info.Capacity, _ = strconv.Atoi(val)
+	case "POWER_SUPPLY_CAPACITY_ERROR_MARGIN":
+		if v, err := strconv.Atoi(val); err == nil {
+			info.CapacityErrorMargin = v
+			info.HasCapacityErrorMargin = true
+		}
+	case "POWER_SUPPLY_POWER_NOW":
+		if v, err := strconv.Atoi(val); err == nil {
+			info.PowerNow = v
+			info.HasPowerNow = true
+		}
+	case "POWER_SUPPLY_TEMP":
+		if v, err := strconv.Atoi(val); err == nil {
+			info.Temp = v
+			info.HasTemp = true
+		}
+	case "POWER_SUPPLY_CURRENT_NOW":
+		if v, err := strconv.Atoi(val); err == nil {
+			info.CurrentNow = v
+			info.HasCurrentNow = true
+		}
+	case "POWER_SUPPLY_CHARGE_COUNTER":
+		if v, err := strconv.Atoi(val); err == nil {
+			info.ChargeCounter = v
+			info.HasChargeCounter = true
+		}
+	case "POWER_SUPPLY_SCOPE":
+		info.Scope = val
+	case "POWER_SUPPLY_CAPACITY_LEVEL":
+		info.CapacityLevel = val
+	case "POWER_SUPPLY_MODEL_NAME":
+		info.Model = val
+	case "POWER_SUPPLY_MANUFACTURER":
+		info.Manufacturer = val
+	case "POWER_SUPPLY_SERIAL_NUMBER":
+		info.Serial = val
+	}
+}
+
+// readSysfsInt reads an integer attribute file of a power supply. A
+// missing or unparsable file is reported as not present.
+func readSysfsInt(name, attr string) (int, bool) {
+	data, err := os.ReadFile(powerSupplyPath(name, attr))
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// numericFields returns pointers to the numeric BatteryInfo fields that
+// are smoothed when median sampling is enabled.
+func numericFields(info *BatteryInfo) []*int {
+	return []*int{
+		&info.CycleCount,
+		&info.VoltageNow,
+		&info.EnergyFull,
+		&info.EnergyNow,
+		&info.EnergyDesign,
+		&info.ChargeNow,
+		&info.ChargeFull,
+		&info.ChargeDesign,
+		&info.Capacity,
+		&info.ChargeCounter,
+		&info.PowerNow,
+		&info.CapacityErrorMargin,
+		&info.VoltageOCV,
+		&info.CurrentNow,
+		&info.Temp,
+	}
+}
+
+func medianInt(vals []int) int {
+	sorted := append([]int(nil), vals...)
+	sort.Ints(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// readBatteryInfoSampled reads the battery once, or several times when
+// sampling is enabled, returning the per-field median. Non-numeric fields
+// are taken from the last successful read.
+func readBatteryInfoSampled(name string) (*BatteryInfo, error) {
+	if !config.Sampling.Enabled || config.Sampling.Samples <= 1 {
+		return readBatteryInfo(name)
+	}
+	delay := time.Duration(config.Sampling.DelayMs) * time.Millisecond
+	if delay == 0 {
+		delay = 50 * time.Millisecond
+	}
+
+	var samples []*BatteryInfo
+	var lastErr error
+	for i := 0; i < config.Sampling.Samples; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		info, err := readBatteryInfo(name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		samples = append(samples, info)
+	}
+	if len(samples) == 0 {
+		return nil, lastErr
+	}
+
+	return medianInfo(samples), nil
+}
+
+// medianInfo combines readings into the per-field median of the numeric
+// fields, with the other fields from the last reading.
+func medianInfo(samples []*BatteryInfo) *BatteryInfo {
+	result := *samples[len(samples)-1]
+	dst := numericFields(&result)
+	vals := make([]int, len(samples))
+	for i := range dst {
+		for j, s := range samples {
+			vals[j] = *numericFields(s)[i]
+		}
+		*dst[i] = medianInt(vals)
+	}
+	return &result
+}
+
+// maxSampleGap is the longest time between two samples of a battery that
+// still counts as consecutive polls.
+func maxSampleGap() time.Duration {
+	return 2 * pollInterval()
+}
+
+// cellCount returns the number of series cells in the pack, from config if
+// set, otherwise inferred from the design voltage assuming Li-ion cells
+// (~3.8V each, so 11.1V/11.4V/12.6V packs all come out as 3 cells).
+// Returns 0 when it cannot be determined.
+func cellCount(info *BatteryInfo) int {
+	if n, ok := config.CellCount[info.Name]; ok && n > 0 {
+		return n
+	}
+	if info.Technology != "" && !strings.HasPrefix(info.Technology, "Li") {
+		return 0
+	}
+	design := info.VoltageMinDesign
+	if design == 0 {
+		design = info.VoltageMaxDesign
+	}
+	if design == 0 {
+		return 0
+	}
+	return int(math.Round(float64(design) / 3800000.0))
+}
+
+func stateFor(name string) *batteryState {
+	st, ok := batStates[name]
+	if !ok {
+		st = &batteryState{}
+		batStates[name] = st
+	}
+	return st
+}
+
+// applyDesignOverride replaces EnergyDesign with the configured value when
+// the driver reports zero or something smaller than half of EnergyFull,
+// which would put health above 200%.
+func applyDesignOverride(info *BatteryInfo) {
+	wh, ok := config.DesignCapacityWh[info.Name]
+	if !ok || wh <= 0 {
+		return
+	}
+	st := stateFor(info.Name)
+	if chargeBased(info) {
+		if info.ChargeDesign > 0 && info.ChargeDesign*2 >= info.ChargeFull {
+			return
+		}
+		// Converting needs the nominal voltage; VOLTAGE_NOW would make
+		// the health move with the charge level
+		if info.VoltageMinDesign <= 0 {
+			if !st.designOverrideLogged {
+				log.Printf("%s: design_capacity_wh ignored, the battery reports charge but no VOLTAGE_MIN_DESIGN to convert with", info.Name)
+				st.designOverrideLogged = true
+			}
+			return
+		}
+		if !st.designOverrideLogged {
+			log.Printf("%s: design capacity %d µAh looks wrong, using configured %.2f Wh at %.2f V", info.Name, info.ChargeDesign, wh, float64(info.VoltageMinDesign)/1000000.0)
+			st.designOverrideLogged = true
+		}
+		info.ChargeDesign = int(wh * 1e12 / float64(info.VoltageMinDesign))
+		return
+	}
+	if info.EnergyDesign > 0 && info.EnergyDesign*2 >= info.EnergyFull {
+		return
+	}
+	if !st.designOverrideLogged {
+		log.Printf("%s: design capacity %d µWh looks wrong, using configured %.2f Wh", info.Name, info.EnergyDesign, wh)
+		st.designOverrideLogged = true
+	}
+	info.EnergyDesign = int(wh * 1000000.0)
+}
+
+// updateHealthBaseline records health into the hourly buckets and returns
+// the minimum over the trailing 24 hours.
+func updateHealthBaseline(name string, health float64, now time.Time) float64 {
+	st := stateFor(name)
+	hour := now.Unix() / 3600
+	slot := hour % 24
+	if st.healthHour[slot] != hour {
+		st.healthHour[slot] = hour
+		st.healthMin[slot] = health
+	} else if health < st.healthMin[slot] {
+		st.healthMin[slot] = health
+	}
+
+	baseline := health
+	for i := range st.healthMin {
+		if st.healthHour[i] > hour-24 && st.healthMin[i] < baseline {
+			baseline = st.healthMin[i]
+		}
+	}
+	return baseline
+}
+
+// statusElapsed returns the time since the battery's previous sample, to be
+// credited to its current status. Zero on the first sample.
+func statusElapsed(name string, now time.Time) time.Duration {
+	st := stateFor(name)
+	var elapsed time.Duration
+	// Across a gap (suspend, paused collection, failed reads) the status
+	// in between is unknown, so it is not credited to any state
+	if !st.lastStatusSample.IsZero() && now.Sub(st.lastStatusSample) <= maxSampleGap() {
+		elapsed = now.Sub(st.lastStatusSample)
+	}
+	st.lastStatusSample = now
+	return elapsed
+}
+
+// chargeBased reports whether the battery reports CHARGE_* (µAh) values
+// only. ENERGY_* values are preferred when both are present.
+func chargeBased(info *BatteryInfo) bool {
+	return info.EnergyFull == 0 && info.EnergyNow == 0 && info.ChargeFull > 0
+}
+
+// energyNow returns the remaining energy in µWh, derived from charge and
+// voltage on charge-based batteries.
+func energyNow(info *BatteryInfo) int {
+	if chargeBased(info) {
+		return int(int64(info.ChargeNow) * int64(info.VoltageNow) / 1000000)
+	}
+	return info.EnergyNow
+}
+
+// updateEnergySinceFull integrates discharge energy between polls and
+// resets the total whenever the battery reports Full. Power draw is used
+// when the driver exposes it, otherwise the drop in ENERGY_NOW. Across a
+// gap longer than maxSampleGap the draw is unknown, so the drop is used.
+func updateEnergySinceFull(info *BatteryInfo, now time.Time) float64 {
+	st := stateFor(info.Name)
+
+	switch {
+	case info.Status == "Full":
+		st.energySinceFull = 0
+	case info.Status == "Discharging" && !st.lastSample.IsZero():
+		if info.HasPowerNow && now.Sub(st.lastSample) <= maxSampleGap() {
+			hours := now.Sub(st.lastSample).Hours()
+			st.energySinceFull += float64(info.PowerNow) / 1000000.0 * hours
+		} else if drop := st.lastEnergyNow - energyNow(info); drop > 0 {
+			st.energySinceFull += float64(drop) / 1000000.0
+		}
+	}
+	st.lastSample = now
+	st.lastEnergyNow = energyNow(info)
+	return st.energySinceFull
+}
+
+// batteryID returns the battery label value for a reading.
+func batteryID(info *BatteryInfo) string {
+	if config.LabelBy == "serial" && strings.TrimSpace(info.Serial) != "" {
+		return strings.TrimSpace(info.Serial)
+	}
+	return info.Name
+}
+
+// batteryLabelValues returns the label values matching batteryLabels.
+func batteryLabelValues(name, id string) []string {
+	return []string{id, config.Locations[name]}
+}
+
+// initPrometheusMetrics creates and registers all metrics. It fails,
+// rather than panicking in MustRegister, when two enabled features define
+// the same metric name. On failure nothing it created stays registered and
+// the previous collectors are put back, so a reload can try again.
+func initPrometheusMetrics() (err error) {
+	prevGauges, prevCounters, prevAdapter, prevSystem, prevHists := batteryGauges, promCounters, adapterGauges, systemGauges, promHists
+	prevScrape, prevMtime, prevReloads, prevPowercap := scrapeSuccess, configMtimeGauge, configReloads, powercapGauge
+	var registered []prometheus.Collector
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, c := range registered {
+			prometheus.Unregister(c)
+		}
+		batteryGauges, promCounters, adapterGauges, systemGauges, promHists = prevGauges, prevCounters, prevAdapter, prevSystem, prevHists
+		scrapeSuccess, configMtimeGauge, configReloads, powercapGauge = prevScrape, prevMtime, prevReloads, prevPowercap
+	}()
+
+	promCounters = make(map[string]*prometheus.CounterVec)
+	adapterGauges = make(map[string]*prometheus.GaugeVec)
+	systemGauges = make(map[string]prometheus.Gauge)
+	promHists = make(map[string]*prometheus.HistogramVec)
+	batteryGauges = map[string]*prometheus.GaugeVec{
+		"percentage": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_percentage",
+			Help: metricHelp("battery_percentage", "Battery charge percentage"),
+		}, batteryLabels),
+		"capacity": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_capacity_percent",
+			Help: metricHelp("battery_capacity_percent", "Battery health/capacity compared to design"),
+		}, batteryLabels),
+		"charging": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charging",
+			Help: metricHelp("battery_charging", "1 if charging, 0 if discharging, 2 if full"),
+		}, batteryLabels),
+		"voltage": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_voltage_volts",
+			Help: metricHelp("battery_voltage_volts", "Current battery voltage in volts"),
+		}, batteryLabels),
+		"energy_now": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_energy_wh",
+			Help: metricHelp("battery_energy_wh", "Current energy in Wh"),
+		}, batteryLabels),
+		"cycle_count": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_cycle_count",
+			Help: metricHelp("battery_cycle_count", "Battery cycle count"),
+		}, batteryLabels),
+		"charge_counter": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charge_counter_ah",
+			Help: metricHelp("battery_charge_counter_ah", "Accumulated charge from the fuel gauge in Ah (signed, may reset)"),
+		}, batteryLabels),
+		"energy_since_full": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_energy_since_full_wh",
+			Help: metricHelp("battery_energy_since_full_wh", "Energy discharged since the battery was last Full in Wh"),
+		}, batteryLabels),
+		"voltage_ocv": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_voltage_ocv_volts",
+			Help: metricHelp("battery_voltage_ocv_volts", "Battery open-circuit voltage in volts"),
+		}, batteryLabels),
+		"voltage_per_cell": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_voltage_per_cell_volts",
+			Help: metricHelp("battery_voltage_per_cell_volts", "Battery voltage divided by the number of series cells"),
+		}, batteryLabels),
+		"capacity_error_margin": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_capacity_error_margin_percent",
+			Help: metricHelp("battery_capacity_error_margin_percent", "Fuel gauge uncertainty on the charge percentage"),
+		}, batteryLabels),
+		"charge_target_reached": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charge_target_reached",
+			Help: metricHelp("battery_charge_target_reached", "1 if the charge percentage is at or above the charge target"),
+		}, batteryLabels),
+		"charge_limit_end": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charge_limit_end_percent",
+			Help: metricHelp("battery_charge_limit_end_percent", "Charge percentage at which the firmware stops charging (charge_control_end_threshold)"),
+		}, batteryLabels),
+		"charge_limit_start": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charge_limit_start_percent",
+			Help: metricHelp("battery_charge_limit_start_percent", "Charge percentage below which the firmware starts charging (charge_control_start_threshold)"),
+		}, batteryLabels),
+		"health_baseline": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_capacity_health_baseline_percent",
+			Help: metricHelp("battery_capacity_health_baseline_percent", "Minimum battery health over the trailing 24 hours"),
+		}, batteryLabels),
+		"internal_resistance": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_internal_resistance_ohms",
+			Help: metricHelp("battery_internal_resistance_ohms", "Estimated internal resistance from (OCV - voltage) / current"),
+		}, batteryLabels),
+		"thermal_throttled": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charge_thermal_throttled",
+			Help: metricHelp("battery_charge_thermal_throttled", "1 if charging appears to be held back because the pack is hot"),
+		}, batteryLabels),
+		"learned_full_capacity": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_learned_full_capacity_wh",
+			Help: metricHelp("battery_learned_full_capacity_wh", "Latest learned full-charge capacity from the configured vendor log"),
+		}, batteryLabels),
+		"cell_voltage": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_cell_voltage_volts",
+			Help: metricHelp("battery_cell_voltage_volts", "Voltage of an individual cell from the configured vendor file"),
+		}, append(append([]string(nil), batteryLabels...), "cell")),
+		"capacity_level": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_capacity_level_info",
+			Help: metricHelp("battery_capacity_level_info", "Always 1; the level label carries POWER_SUPPLY_CAPACITY_LEVEL"),
+		}, append(append([]string(nil), batteryLabels...), "level")),
+		"info": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_info",
+			Help: metricHelp("battery_info", "Always 1; labels carry the battery's model, manufacturer, serial and technology"),
+		}, append(append([]string(nil), batteryLabels...), "model", "manufacturer", "serial", "technology")),
+		"capacity_band": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_capacity_band",
+			Help: metricHelp("battery_capacity_band", "Capacity level as a number: 4 Full, 3 High/Normal, 2 Low, 1 Critical, 0 Unknown"),
+		}, batteryLabels),
+		"temperature": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_temperature_celsius",
+			Help: metricHelp("battery_temperature_celsius", "Battery pack temperature"),
+		}, batteryLabels),
+		"power": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_power_watts",
+			Help: metricHelp("battery_power_watts", "Instantaneous charge or discharge power"),
+		}, batteryLabels),
+		"time_to_empty": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_time_to_empty_seconds",
+			Help: metricHelp("battery_time_to_empty_seconds", "Estimated time until empty while discharging"),
+		}, batteryLabels),
+		"time_to_full": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_time_to_full_seconds",
+			Help: metricHelp("battery_time_to_full_seconds", "Estimated time until full while charging"),
+		}, batteryLabels),
+		"charge_inhibited": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_charge_control_inhibited",
+			Help: metricHelp("battery_charge_control_inhibited", "1 if charge_control currently inhibits charging"),
+		}, batteryLabels),
+		"percentage_discrepancy": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_percentage_discrepancy",
+			Help: metricHelp("battery_percentage_discrepancy", "Absolute difference between reported and energy-derived charge percentage"),
+		}, batteryLabels),
+		"gauge_miscalibrated": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "battery_gauge_miscalibrated",
+			Help: metricHelp("battery_gauge_miscalibrated", "1 if the percentage discrepancy exceeds the configured threshold"),
+		}, batteryLabels),
+	}
+	promCounters["ac_plug"] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ac_plug_events_total",
+		Help: metricHelp("ac_plug_events_total", "Number of times the AC adapter was plugged in"),
+	}, []string{"adapter"})
+	promCounters["ac_unplug"] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ac_unplug_events_total",
+		Help: metricHelp("ac_unplug_events_total", "Number of times the AC adapter was unplugged"),
+	}, []string{"adapter"})
+	promCounters["charge_control_writes"] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "battery_charge_control_writes_total",
+		Help: metricHelp("battery_charge_control_writes_total", "Number of sysfs writes made by charge_control"),
+	}, batteryLabels)
+	promCounters["time_in_state"] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "battery_time_in_state_seconds",
+		Help: metricHelp("battery_time_in_state_seconds", "Cumulative time spent in each battery status"),
+	}, append(append([]string(nil), batteryLabels...), "state"))
+
+	adapterGauges["online"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "power_adapter_online",
+		Help: metricHelp("power_adapter_online", "1 if the adapter (Mains or USB supply) is online"),
+	}, []string{"adapter"})
+	adapterGauges["max_voltage"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ac_adapter_max_voltage_volts",
+		Help: metricHelp("ac_adapter_max_voltage_volts", "Maximum voltage advertised by the adapter"),
+	}, []string{"adapter"})
+	adapterGauges["max_current"] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ac_adapter_max_current_amps",
+		Help: metricHelp("ac_adapter_max_current_amps", "Maximum current advertised by the adapter"),
+	}, []string{"adapter"})
+
+	histOpts := prometheus.HistogramOpts{
+		Name:    "battery_power_draw_watts",
+		Help:    metricHelp("battery_power_draw_watts", "Distribution of discharge power draw"),
+		Buckets: []float64{1, 2, 5, 10, 15, 20, 30, 45, 65, 100},
+	}
+	if config.Prometheus.NativeHistograms {
+		histOpts.NativeHistogramBucketFactor = 1.1
+		histOpts.NativeHistogramMaxBucketNumber = 100
+		histOpts.NativeHistogramMinResetDuration = time.Hour
+	}
+	promHists["power_draw"] = prometheus.NewHistogramVec(histOpts, batteryLabels)
+
+	systemGauges["power"] = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "system_power_watts",
+		Help: metricHelp("system_power_watts", "Estimated total system power draw (NaN when it cannot be estimated)"),
+	})
+	systemGauges["on_battery"] = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "system_on_battery",
+		Help: metricHelp("system_on_battery", "1 if AC is offline and a system battery is discharging"),
+	})
+
+	if config.Powercap {
+		powercapGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cpu_power_watts",
+			Help: metricHelp("cpu_power_watts", "Average power of a powercap (RAPL) zone since the previous poll"),
+		}, []string{"zone"})
+	}
+
+	scrapeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "battery_last_scrape_success",
+		Help: metricHelp("battery_last_scrape_success", "0 once reading the battery failed scrape_failure_threshold times in a row"),
+	}, batteryLabels)
+
+	configMtimeGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "power_exporter_config_mtime_seconds",
+		Help: metricHelp("power_exporter_config_mtime_seconds", "Modification time of the loaded config file"),
+	}, func() float64 {
+		if configMtime.IsZero() {
+			return math.NaN()
+		}
+		return float64(configMtime.UnixNano()) / 1e9
+	})
+
+	configReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "power_exporter_reloads_total",
+		Help: metricHelp("power_exporter_reloads_total", "Number of successful configuration reloads"),
+	})
+
+	collectors := namedCollectors()
+	names, err := checkMetricNames(collectors)
+	if err != nil {
+		return err
+	}
+	for name := range config.Prometheus.Help {
+		if !names[name] {
+			return fmt.Errorf("prometheus.help: unknown or disabled metric %q", name)
+		}
+	}
+	// Battery gauges are registered behind one collector when they carry
+	// read timestamps
+	var tc *timestampCollector
+	if config.Prometheus.Timestamps {
+		tc = &timestampCollector{}
+	}
+	for _, nc := range collectors {
+		if g, ok := nc.Collector.(*prometheus.GaugeVec); ok && tc != nil && strings.HasPrefix(nc.Feature, "battery gauge ") {
+			tc.vecs = append(tc.vecs, g)
+			continue
+		}
+		if err := prometheus.Register(nc.Collector); err != nil {
+			return fmt.Errorf("registering %s: %w", nc.Feature, err)
+		}
+		registered = append(registered, nc.Collector)
+	}
+	if tc != nil {
+		if err := prometheus.Register(tc); err != nil {
+			return fmt.Errorf("registering battery gauges: %w", err)
+		}
+	}
+	return nil
+}
+
+// namedCollector is a collector with the feature that defines it, for
+// error messages.
+type namedCollector struct {
+	Feature string
+	prometheus.Collector
+}
+
+// namedCollectors returns all collectors created by initPrometheusMetrics
+// in a stable order.
+func namedCollectors() []namedCollector {
+	var result []namedCollector
+	add := func(feature string, keys []string, get func(string) prometheus.Collector) {
+		sort.Strings(keys)
+		for _, k := range keys {
+			result = append(result, namedCollector{feature + " " + k, get(k)})
+		}
+	}
+	add("battery gauge", mapKeys(batteryGauges), func(k string) prometheus.Collector { return batteryGauges[k] })
+	add("counter", mapKeys(promCounters), func(k string) prometheus.Collector { return promCounters[k] })
+	add("adapter gauge", mapKeys(adapterGauges), func(k string) prometheus.Collector { return adapterGauges[k] })
+	add("system gauge", mapKeys(systemGauges), func(k string) prometheus.Collector { return systemGauges[k] })
+	add("histogram", mapKeys(promHists), func(k string) prometheus.Collector { return promHists[k] })
+	if scrapeSuccess != nil {
+		result = append(result, namedCollector{"scrape success", scrapeSuccess})
+	}
+	if configMtimeGauge != nil {
+		result = append(result, namedCollector{"config mtime", configMtimeGauge})
+		result = append(result, namedCollector{"config reloads", configReloads})
+	}
+	if powercapGauge != nil {
+		result = append(result, namedCollector{"powercap", powercapGauge})
+	}
+	return result
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// descName extracts the metric name from a Desc, which has no accessor.
+var descName = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// metricHelp returns the prometheus.help override for a metric, or def.
+func metricHelp(name, def string) string {
+	if h, ok := config.Prometheus.Help[name]; ok && h != "" {
+		return h
+	}
+	return def
+}
+
+// checkMetricNames reports metric names defined by more than one
+// collector and returns the set of all names.
+func checkMetricNames(collectors []namedCollector) (map[string]bool, error) {
+	owners := make(map[string]string)
+	for _, nc := range collectors {
+		ch := make(chan *prometheus.Desc)
+		go func() {
+			nc.Describe(ch)
+			close(ch)
+		}()
+		var names []string
+		for d := range ch {
+			if m := descName.FindStringSubmatch(d.String()); m != nil {
+				names = append(names, m[1])
+			}
+		}
+		for _, name := range names {
+			if prev, ok := owners[name]; ok {
+				return nil, fmt.Errorf("metric %s is defined by both %s and %s", name, prev, nc.Feature)
+			}
+			owners[name] = nc.Feature
+		}
+	}
+	names := make(map[string]bool, len(owners))
+	for name := range owners {
+		names[name] = true
+	}
+	return names, nil
+}
+
+// timestampCollector wraps the battery GaugeVecs and stamps each metric
+// with the time its battery was last read.
+type timestampCollector struct {
+	vecs []*prometheus.GaugeVec
+}
+
+func (c *timestampCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range c.vecs {
+		v.Describe(ch)
+	}
+}
+
+func (c *timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	inner := make(chan prometheus.Metric)
+	go func() {
+		for _, v := range c.vecs {
+			v.Collect(inner)
+		}
+		close(inner)
+	}()
+
+	readTimesMu.Lock()
+	byID := make(map[string]time.Time, len(readTimes))
+	for name, t := range readTimes {
+		byID[batteryIDs[name]] = t
+	}
+	readTimesMu.Unlock()
+	for m := range inner {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			ch <- m
+			continue
+		}
+		var t time.Time
+		for _, lp := range pb.GetLabel() {
+			if lp.GetName() == "battery" {
+				t = byID[lp.GetValue()]
+				break
+			}
+		}
+		if t.IsZero() {
+			ch <- m
+			continue
+		}
+		ch <- prometheus.NewMetricWithTimestamp(t.Add(clockOffset()), m)
+	}
+}
+
+// updateAdapters reads every adapter, updates its metrics and returns
+// the readings that succeeded.
+func updateAdapters() []*AdapterInfo {
+	var result []*AdapterInfo
+	for _, name := range adapters {
+		info, err := readAdapterInfo(name)
+		if err != nil {
+			logError("read", "Error reading %s: %v", name, err)
+			continue
+		}
+		result = append(result, info)
+		readTimesMu.Lock()
+		adapterReadTime = time.Now()
+		readTimesMu.Unlock()
+		countAdapterEvent(info)
+
+		if len(adapterGauges) == 0 {
+			continue
+		}
+		if info.Online {
+			adapterGauges["online"].WithLabelValues(name).Set(1)
+		} else {
+			adapterGauges["online"].WithLabelValues(name).Set(0)
+		}
+		// Capabilities disappear when the charger is unplugged; drop the
+		// series rather than keep reporting the old adapter.
+		if info.HasVoltageMax && info.VoltageMax > 0 {
+			adapterGauges["max_voltage"].WithLabelValues(name).Set(float64(info.VoltageMax) / 1000000.0)
+		} else {
+			adapterGauges["max_voltage"].DeleteLabelValues(name)
+		}
+		if info.HasCurrentMax && info.CurrentMax > 0 {
+			adapterGauges["max_current"].WithLabelValues(name).Set(float64(info.CurrentMax) / 1000000.0)
+		} else {
+			adapterGauges["max_current"].DeleteLabelValues(name)
+		}
+	}
+	return result
+}
+
+// systemPower estimates total system draw in watts. On battery it is the
+// sum of discharge power; on AC it is adapter input minus the power going
+// into charging batteries. Returns false when the needed readings are not
+// available (e.g. a Mains adapter that does not report its input power).
+func systemPower(readings map[string]*batteryMetrics, adapterInfos []*AdapterInfo) (float64, bool) {
+	var input float64
+	var haveInput, anyOnline bool
+	for _, a := range adapterInfos {
+		if a.Online {
+			anyOnline = true
+		}
+		if w, ok := a.inputPower(); ok {
+			input += w
+			haveInput = true
+		}
+	}
+
+	var discharge, charge float64
+	var system int
+	for _, m := range readings {
+		// Peripheral batteries do not power the machine
+		if m.Info.Scope == "Device" {
+			continue
+		}
+		system++
+		w, ok := batteryPower(m.Info)
+		switch m.Info.Status {
+		case "Discharging":
+			if !ok {
+				return 0, false
+			}
+			discharge += w
+		case "Charging":
+			if !ok {
+				return 0, false
+			}
+			charge += w
+		}
+	}
+
+	if !anyOnline {
+		if system == 0 {
+			return 0, false
+		}
+		return discharge, true
+	}
+	if !haveInput {
+		return 0, false
+	}
+	// On AC a discharging battery supplements the adapter
+	return math.Max(input-charge+discharge, 0), true
+}
+
+// powercapZone is an energy counter under /sys/class/powercap.
+type powercapZone struct {
+	Path  string
+	Label string
+}
+
+// powercapSample is the previous energy reading of a zone.
+type powercapSample struct {
+	EnergyUJ int64
+	Time     time.Time
+}
+
+// findPowercapZones walks the powercap tree from each control type
+// (intel-rapl, intel-rapl-mmio, ...) into its nested zones. Zones are
+// labelled by their name file; a name already taken (e.g. the dram zone
+// of a second package) gets its parent's label as a prefix.
+func findPowercapZones(root string) []powercapZone {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var zones []powercapZone
+	used := make(map[string]bool)
+	var walk func(dir, parent string)
+	walk = func(dir, parent string) {
+		label := parent
+		if _, err := os.Stat(filepath.Join(dir, "energy_uj")); err == nil {
+			label = filepath.Base(dir)
+			if data, err := os.ReadFile(filepath.Join(dir, "name")); err == nil {
+				label = strings.TrimSpace(string(data))
+			}
+			if used[label] && parent != "" {
+				label = parent + "/" + label
+			}
+			if used[label] {
+				label = filepath.Base(dir)
+			}
+			used[label] = true
+			zones = append(zones, powercapZone{Path: dir, Label: label})
+		}
+		subs, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		base := filepath.Base(dir)
+		for _, s := range subs {
+			// Zone children are named <parent>:<n>; other entries are
+			// constraints, device links and power attributes
+			if strings.HasPrefix(s.Name(), base+":") {
+				walk(filepath.Join(dir, s.Name()), label)
+			}
+		}
+	}
+	for _, e := range entries {
+		// The top-level directory also links every zone flat; start only
+		// from the control types and rely on the walk for the rest
+		if strings.Contains(e.Name(), ":") {
+			continue
+		}
+		walk(filepath.Join(root, e.Name()), "")
+	}
+	return zones
+}
+
+// readPowercapInt reads an integer attribute of a powercap zone.
+func readPowercapInt(dir, attr string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// updatePowercap reads the zone energy counters and returns the average
+// power per zone label since the previous call. Zones read for the first
+// time have no value yet. Unreadable energy_uj files (root-only on newer
+// kernels) are logged once and skipped.
+func updatePowercap(now time.Time) map[string]float64 {
+	result := make(map[string]float64)
+	for _, z := range findPowercapZones(powercapPath()) {
+		energy, err := readPowercapInt(z.Path, "energy_uj")
+		if err != nil {
+			if errors.Is(err, fs.ErrPermission) && !powercapDenied[z.Path] {
+				log.Printf("Powercap zone %s: %v (run as root to read it)", z.Label, err)
+				powercapDenied[z.Path] = true
+			}
+			continue
+		}
+		prev, ok := powercapSamples[z.Path]
+		powercapSamples[z.Path] = powercapSample{EnergyUJ: energy, Time: now}
+		if !ok {
+			continue
+		}
+		dt := now.Sub(prev.Time).Seconds()
+		if dt <= 0 {
+			continue
+		}
+		delta := energy - prev.EnergyUJ
+		if delta < 0 {
+			// The counter wrapped around max_energy_range_uj
+			maxRange, err := readPowercapInt(z.Path, "max_energy_range_uj")
+			if err != nil {
+				continue
+			}
+			delta += maxRange
+		}
+		result[z.Label] = float64(delta) / 1e6 / dt
+	}
+	return result
+}
+
+// onBattery reports whether the machine runs from its own batteries: no
+// adapter is online and a system battery is discharging. Device-scope
+// batteries (peripherals) are ignored.
+func onBattery(readings map[string]*batteryMetrics, adapterInfos []*AdapterInfo) bool {
+	for _, a := range adapterInfos {
+		if a.Online {
+			return false
+		}
+	}
+	for _, m := range readings {
+		if m.Info.Scope != "Device" && m.Info.Status == "Discharging" {
+			return true
+		}
+	}
+	return false
+}
+
+// countAdapterEvent counts online/offline transitions for an adapter.
+// The first observation only records the state.
+func countAdapterEvent(info *AdapterInfo) {
+	prev, seen := adapterOnline[info.Name]
+	adapterOnline[info.Name] = info.Online
+	if len(promCounters) == 0 {
+		return
+	}
+	// Both series exist from the start so increase() sees the first event
+	plug := promCounters["ac_plug"].WithLabelValues(info.Name)
+	unplug := promCounters["ac_unplug"].WithLabelValues(info.Name)
+	if !seen || prev == info.Online {
+		return
+	}
+	if info.Online {
+		plug.Inc()
+	} else {
+		unplug.Inc()
+	}
+}
+
+// batteryMetrics holds the values derived from one battery reading.
+type batteryMetrics struct {
+	Info            *BatteryInfo
+	Percentage      float64
+	CapacityHealth  float64
+	Charging        float64
+	Voltage         float64
+	VoltageOCV      float64
+	EnergyWh        float64
+	EnergySinceFull float64
+	// WarmedUp is false until the battery has two samples; metrics that
+	// integrate between samples are not exported before that.
+	WarmedUp        bool
+	ChargeCounterAh float64
+	Cells           int
+	VoltagePerCell  float64
+	ChargeTarget    int // 0 when no target is known
+	TargetReached   float64
+	HealthBaseline  float64
+	// InternalResistance is in ohms; negative when it cannot be estimated.
+	InternalResistance float64
+	StatusElapsed      time.Duration
+	ThermalThrottled   float64
+	// ChargeInhibited is the charge_control decision; only meaningful
+	// with HasChargeControl in charge_behaviour mode.
+	ChargeInhibited  float64
+	HasChargeControl bool
+	// ChargeControlWrites is how many sysfs writes this cycle made.
+	ChargeControlWrites int
+	// Discrepancy is in percentage points; negative when the full
+	// energy or charge is unknown.
+	Discrepancy   float64
+	Miscalibrated float64
+	// TimeToEmpty and TimeToFull are in seconds; at most one is set, by
+	// status, and both are negative when the rate is unknown or zero.
+	TimeToEmpty float64
+	TimeToFull  float64
+}
+
+// thermalThrottled guesses whether firmware is holding back charging
+// because the pack is hot. Requires POWER_SUPPLY_TEMP.
+func thermalThrottled(info *BatteryInfo, targetReached bool) bool {
+	threshold := config.ThermalThrottle.TempCelsius
+	if threshold == 0 {
+		threshold = 45
+	}
+	if float64(info.Temp)/10.0 < threshold {
+		return false
+	}
+	switch info.Status {
+	case "Not charging":
+		// Not charging because of a charge limit is not throttling
+		return !targetReached && info.Capacity < 100
+	case "Charging":
+		minCurrent := config.ThermalThrottle.MinChargeCurrentMA * 1000
+		if minCurrent == 0 || !info.HasCurrentNow {
+			return false
+		}
+		current := info.CurrentNow
+		if current < 0 {
+			current = -current
+		}
+		return current < minCurrent
+	}
+	return false
+}
+
+// batteryPower returns the battery's charge or discharge power in watts,
+// from POWER_NOW or else CURRENT_NOW × VOLTAGE_NOW, as a magnitude.
+func batteryPower(info *BatteryInfo) (float64, bool) {
+	if info.HasPowerNow {
+		return math.Abs(float64(info.PowerNow)) / 1000000.0, true
+	}
+	if info.HasCurrentNow && info.VoltageNow > 0 {
+		return math.Abs(float64(info.CurrentNow)) * float64(info.VoltageNow) / 1e12, true
+	}
+	return 0, false
+}
+
+// timeRemaining estimates the seconds until empty while discharging and
+// until full while charging. Charge-based batteries use CHARGE_* over
+// CURRENT_NOW, others ENERGY_* over the power draw. Both results are -1
+// when the direction or rate is unknown.
+func timeRemaining(info *BatteryInfo) (empty, full float64) {
+	empty, full = -1, -1
+	var now, capacity, rate float64
+	if chargeBased(info) && info.HasCurrentNow {
+		now, capacity = float64(info.ChargeNow), float64(info.ChargeFull)
+		rate = math.Abs(float64(info.CurrentNow))
+	} else if w, ok := batteryPower(info); ok {
+		now, capacity = float64(energyNow(info)), float64(info.EnergyFull)
+		if chargeBased(info) {
+			capacity = float64(info.ChargeFull) * float64(info.VoltageNow) / 1000000
+		}
+		rate = w * 1000000
+	}
+	if rate == 0 {
+		return
+	}
+	switch info.Status {
+	case "Discharging":
+		empty = now / rate * 3600
+	case "Charging":
+		if capacity > now {
+			full = (capacity - now) / rate * 3600
+		} else {
+			full = 0
+		}
+	}
+	return
+}
+
+// minResistanceCurrent is the smallest current (µA) at which the voltage
+// sag is large enough to give a meaningful resistance estimate.
+const minResistanceCurrent = 50000
+
+// internalResistance estimates the pack resistance from the difference
+// between open-circuit and loaded voltage. Returns -1 when OCV or current
+// is missing, the current is too small, or the battery is idle.
+func internalResistance(info *BatteryInfo) float64 {
+	if !info.HasVoltageOCV || !info.HasCurrentNow {
+		return -1
+	}
+	current := info.CurrentNow
+	if current < 0 {
+		current = -current
+	}
+	if current < minResistanceCurrent {
+		return -1
+	}
+	var sag int
+	switch info.Status {
+	case "Discharging":
+		sag = info.VoltageOCV - info.VoltageNow
+	case "Charging":
+		sag = info.VoltageNow - info.VoltageOCV
+	default:
+		return -1
+	}
+	// A negative sag is measurement noise, not negative resistance
+	if sag < 0 {
+		sag = 0
+	}
+	return float64(sag) / float64(current)
+}
+
+func computeMetrics(info *BatteryInfo, now time.Time) *batteryMetrics {
+	m := &batteryMetrics{
+		Info:       info,
+		Percentage: float64(info.Capacity),
+	}
+	charge := chargeBased(info)
+	m.CapacityHealth = 100.0
+	switch {
+	case !charge && info.EnergyDesign > 0:
+		m.CapacityHealth = 100.0 * float64(info.EnergyFull) / float64(info.EnergyDesign)
+	case charge && info.ChargeDesign > 0:
+		m.CapacityHealth = 100.0 * float64(info.ChargeFull) / float64(info.ChargeDesign)
+	}
+	// Status: 0=Discharging, 1=Charging, 2=Full, 3=Not charging
+	switch info.Status {
+	case "Charging":
+		m.Charging = 1.0
+	case "Full":
+		m.Charging = 2.0
+	case "Not charging":
+		m.Charging = 3.0
+	}
+	m.Voltage = float64(info.VoltageNow) / 1000000.0
+	m.VoltageOCV = float64(info.VoltageOCV) / 1000000.0
+	m.EnergyWh = float64(energyNow(info)) / 1000000.0
+	m.ChargeCounterAh = float64(info.ChargeCounter) / 1000000.0
+	m.EnergySinceFull = updateEnergySinceFull(info, now)
+	st := stateFor(info.Name)
+	st.samples++
+	m.WarmedUp = st.samples >= 2
+	m.Cells = cellCount(info)
+	if m.Cells > 0 {
+		m.VoltagePerCell = m.Voltage / float64(m.Cells)
+	}
+	if t, ok := config.ChargeTarget[info.Name]; ok && t > 0 {
+		m.ChargeTarget = t
+	} else if info.HasChargeEndThreshold && info.ChargeEndThreshold > 0 {
+		m.ChargeTarget = info.ChargeEndThreshold
+	}
+	if m.ChargeTarget > 0 && info.Capacity >= m.ChargeTarget {
+		m.TargetReached = 1
+	}
+	if config.HealthBaseline {
+		m.HealthBaseline = updateHealthBaseline(info.Name, m.CapacityHealth, now)
+	}
+	m.InternalResistance = internalResistance(info)
+	m.StatusElapsed = statusElapsed(info.Name, now)
+	m.TimeToEmpty, m.TimeToFull = timeRemaining(info)
+	if info.HasTemp && thermalThrottled(info, m.TargetReached == 1) {
+		m.ThermalThrottled = 1
+	}
+	m.Discrepancy = -1
+	full, remaining := info.EnergyFull, info.EnergyNow
+	if charge {
+		full, remaining = info.ChargeFull, info.ChargeNow
+	}
+	if full > 0 {
+		derived := 100.0 * float64(remaining) / float64(full)
+		m.Discrepancy = math.Abs(m.Percentage - derived)
+		threshold := config.MiscalibrationThreshold
+		if threshold == 0 {
+			threshold = 10
+		}
+		if m.Discrepancy > threshold {
+			m.Miscalibrated = 1
+		}
+	}
+	return m
+}
+
+// influxOutput wraps the async or blocking InfluxDB write API.
+type influxOutput struct {
+	client   influxdb2.Client
+	async    api.WriteAPI
+	blocking api.WriteAPIBlocking
+}
+
+// newInfluxOutput connects to InfluxDB and checks that it is reachable.
+// Returns nil when InfluxDB output is disabled.
+func newInfluxOutput() (*influxOutput, error) {
+	if !config.InfluxDB.Enabled {
+		return nil, nil
+	}
+	opts := influxdb2.DefaultOptions().SetUseGZip(config.InfluxDB.GZip)
+	if config.InfluxDB.Consistency != "" {
+		opts.WriteOptions().SetConsistency(write.Consistency(config.InfluxDB.Consistency))
+	}
+	token, org := config.InfluxDB.Token, config.InfluxDB.Org
+	if config.InfluxDB.Version == 1 {
+		token, org = config.InfluxDB.Username+":"+config.InfluxDB.Password, ""
+	}
+	o := &influxOutput{
+		client: influxdb2.NewClientWithOptions(config.InfluxDB.URL, token, opts),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if ok, err := o.client.Ping(ctx); !ok {
+		o.client.Close()
+		if err == nil {
+			err = fmt.Errorf("server not ready")
+		}
+		return nil, fmt.Errorf("influxdb ping %s: %w", config.InfluxDB.URL, err)
+	}
+	if config.InfluxDB.Blocking {
+		o.blocking = o.client.WriteAPIBlocking(org, config.InfluxDB.Bucket)
+	} else {
+		o.async = o.client.WriteAPI(org, config.InfluxDB.Bucket)
+		// Async write failures only surface on this channel
+		errs := o.async.Errors()
+		go func() {
+			for err := range errs {
+				logError("influxdb", "InfluxDB write error: %v", err)
+			}
+		}()
+	}
+	return o, nil
+}
+
+// influxWriteTimeout bounds a blocking write, which runs inside the
+// polling cycle, to half the interval (at least a second) rather than the
+// client's 20s default.
+func influxWriteTimeout() time.Duration {
+	return max(pollInterval()/2, time.Second)
+}
+
+func (o *influxOutput) writePoint(p *write.Point) error {
+	if o.blocking != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), influxWriteTimeout())
+		defer cancel()
+		return o.blocking.WritePoint(ctx, p)
+	}
+	o.async.WritePoint(p)
+	return nil
+}
+
+func (o *influxOutput) flush() {
+	if o.async != nil {
+		o.async.Flush()
+	}
+}
+
+// close flushes buffered points and closes the client.
+func (o *influxOutput) close() {
+	o.flush()
+	o.client.Close()
+}
+
+// batteryFields returns the derived values of one reading keyed by field
+// name, as written to InfluxDB and the message-based outputs.
+func batteryFields(m *batteryMetrics) map[string]interface{} {
+	info := m.Info
+	fields := map[string]interface{}{
+		"percentage":      m.Percentage,
+		"capacity_health": m.CapacityHealth,
+		"charging":        m.Charging,
+		"voltage":         m.Voltage,
+		"energy_wh":       m.EnergyWh,
+		"cycle_count":     info.CycleCount,
+		"status":          info.Status,
+	}
+	if m.WarmedUp {
+		fields["energy_since_full"] = m.EnergySinceFull
+	}
+	if info.HasChargeCounter {
+		fields["charge_counter_ah"] = m.ChargeCounterAh
+	}
+	if info.HasVoltageOCV {
+		fields["voltage_ocv"] = m.VoltageOCV
+	}
+	if m.Cells > 0 {
+		fields["voltage_per_cell"] = m.VoltagePerCell
+	}
+	if info.HasCapacityErrorMargin {
+		fields["capacity_error_margin"] = info.CapacityErrorMargin
+	}
+	if m.ChargeTarget > 0 {
+		fields["charge_target_reached"] = m.TargetReached
+	}
+	if info.HasChargeEndThreshold {
+		fields["charge_limit_end"] = info.ChargeEndThreshold
+	}
+	if info.HasChargeStartThreshold {
+		fields["charge_limit_start"] = info.ChargeStartThreshold
+	}
+	if config.HealthBaseline {
+		fields["capacity_health_baseline"] = m.HealthBaseline
+	}
+	if m.InternalResistance >= 0 {
+		fields["internal_resistance"] = m.InternalResistance
+	}
+	if info.HasTemp {
+		fields["temperature_celsius"] = float64(info.Temp) / 10.0
+		fields["charge_thermal_throttled"] = m.ThermalThrottled
+	}
+	if info.HasLearnedFull {
+		fields["learned_full_capacity_wh"] = info.LearnedFullWh
+	}
+	for i, v := range info.CellVoltages {
+		fields[fmt.Sprintf("cell_voltage_%d", i+1)] = v
+	}
+	if w, ok := batteryPower(info); ok {
+		fields["power_watts"] = w
+	}
+	if m.HasChargeControl {
+		fields["charge_control_inhibited"] = m.ChargeInhibited
+	}
+	if info.CapacityLevel != "" {
+		fields["capacity_level"] = info.CapacityLevel
+		fields["capacity_band"] = capacityBand(info.CapacityLevel)
+	}
+	if m.Discrepancy >= 0 {
+		fields["percentage_discrepancy"] = m.Discrepancy
+		fields["gauge_miscalibrated"] = m.Miscalibrated
+	}
+	if m.TimeToEmpty >= 0 {
+		fields["time_to_empty_seconds"] = m.TimeToEmpty
+	}
+	if m.TimeToFull >= 0 {
+		fields["time_to_full_seconds"] = m.TimeToFull
+	}
+	return fields
+}
+
+// outputs holds the push-style backends that initialized successfully.
+// Any of the fields may be nil. Backends being retried in the background
+// are filled in later, so access goes through mu.
+type outputs struct {
+	mu          sync.Mutex
+	influx      *influxOutput
+	kafka       *kafkaOutput
+	nats        *natsOutput
+	sqlite      *sqliteOutput
+	pushgateway bool
+	// gen counts how often each backend was stopped, so a retry loop
+	// notices that a reload replaced the backend it was started for.
+	gen map[string]int
+	// ctx ends the retry loops at shutdown.
+	ctx context.Context
+}
+
+// backendNames lists the outputs in the order they are started.
+var backendNames = []string{"influxdb", "kafka", "nats", "sqlite", "pushgateway"}
+
+// backendConfig returns the config section of a backend in cfg, to detect
+// changes on reload.
+func backendConfig(cfg *Config, name string) (section interface{}, enabled bool) {
+	switch name {
+	case "influxdb":
+		return cfg.InfluxDB, cfg.InfluxDB.Enabled
+	case "kafka":
+		return cfg.Kafka, cfg.Kafka.Enabled
+	case "nats":
+		return cfg.NATS, cfg.NATS.Enabled
+	case "sqlite":
+		return cfg.SQLite, cfg.SQLite.Enabled
+	case "pushgateway":
+		return cfg.Pushgateway, cfg.Pushgateway.Enabled
+	}
+	return nil, false
+}
+
+// close flushes and closes all backends, at shutdown.
+func (o *outputs) close() {
+	for _, name := range backendNames {
+		o.stop(name)
+	}
+}
+
+// stop flushes and closes one backend, leaving the others running.
+func (o *outputs) stop(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.gen[name]++
+	switch name {
+	case "influxdb":
+		if o.influx != nil {
+			o.influx.close()
+			o.influx = nil
+		}
+	case "kafka":
+		if o.kafka != nil {
+			if err := o.kafka.writer.Close(); err != nil {
+				log.Printf("Kafka close error: %v", err)
+			}
+			o.kafka = nil
+		}
+	case "nats":
+		if o.nats != nil {
+			o.nats.close()
+			o.nats = nil
+		}
+	case "sqlite":
+		if o.sqlite != nil {
+			o.sqlite.db.Close()
+			o.sqlite = nil
+		}
+	case "pushgateway":
+		o.pushgateway = false
+	}
+}
+
+// generation returns how often the backend was stopped.
+func (o *outputs) generation(name string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.gen[name]
+}
+
+func (o *outputs) snapshot() *outputs {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return &outputs{influx: o.influx, kafka: o.kafka, nats: o.nats, sqlite: o.sqlite, pushgateway: o.pushgateway}
+}
+
+// backendRetryInterval is how often a failed backend is retried under the
+// "retry" backend_init policy. Tests shorten it.
+var backendRetryInterval = 30 * time.Second
+
+// initBackend runs init and handles failure according to backend_init:
+// "fatal" returns the error so the caller can exit, "warn" continues
+// without the backend and "retry" (the default) keeps calling init in the
+// background until it succeeds, ctx is cancelled or current reports that a
+// reload replaced the backend. After startup "fatal" acts like "warn".
+func initBackend(ctx context.Context, name string, init func() error, current func() bool, startup bool) error {
+	err := init()
+	if err == nil {
+		return nil
+	}
+	switch config.BackendInit {
+	case "fatal":
+		if startup {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("Failed to initialize %s, continuing without it: %v", name, err)
+	case "warn":
+		log.Printf("Failed to initialize %s, continuing without it: %v", name, err)
+	default:
+		log.Printf("Failed to initialize %s, retrying every %s: %v", name, backendRetryInterval, err)
+		go func() {
+			ticker := time.NewTicker(backendRetryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				configMu.RLock()
+				live := current()
+				var err error
+				if live {
+					err = init()
+				}
+				configMu.RUnlock()
+				if !live {
+					log.Printf("%s changed by a reload, no longer retrying", name)
+					return
+				}
+				if err != nil {
+					logError(name, "Retry of %s failed: %v", name, err)
+					continue
+				}
+				log.Printf("%s initialized", name)
+				return
+			}
+		}()
+	}
+	return nil
+}
+
+// initOutputs initializes every enabled backend. Retries of failed
+// backends stop when ctx is cancelled. It fails only for a backend under
+// the "fatal" policy.
+func initOutputs(ctx context.Context) (*outputs, error) {
+	out := &outputs{gen: make(map[string]int), ctx: ctx}
+	for _, name := range backendNames {
+		if _, enabled := backendConfig(&config, name); enabled {
+			if err := out.start(name, true); err != nil {
+				out.close()
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// start initializes one backend under the backend_init policy.
+func (out *outputs) start(name string, startup bool) error {
+	var init func() error
+	switch name {
+	case "influxdb":
+		init = func() error {
+			o, err := newInfluxOutput()
+			if err != nil {
+				return err
+			}
+			out.mu.Lock()
+			out.influx = o
+			out.mu.Unlock()
+			return nil
+		}
+	case "kafka":
+		init = func() error {
+			o, err := newKafkaOutput()
+			if err != nil {
+				return err
+			}
+			out.mu.Lock()
+			out.kafka = o
+			out.mu.Unlock()
+			return nil
+		}
+	case "nats":
+		init = func() error {
+			o, err := newNATSOutput()
+			if err != nil {
+				return err
+			}
+			out.mu.Lock()
+			out.nats = o
+			out.mu.Unlock()
+			return nil
+		}
+	case "sqlite":
+		init = func() error {
+			o, err := newSQLiteOutput()
+			if err != nil {
+				return err
+			}
+			out.mu.Lock()
+			out.sqlite = o
+			out.mu.Unlock()
+			return nil
+		}
+	case "pushgateway":
+		init = func() error {
+			if err := checkPushgateway(); err != nil {
+				return err
+			}
+			out.mu.Lock()
+			out.pushgateway = true
+			out.mu.Unlock()
+			return nil
+		}
+	default:
+		return nil
+	}
+	gen := out.generation(name)
+	current := func() bool {
+		return out.generation(name) == gen
+	}
+	return initBackend(out.ctx, name, init, current, startup)
+}
+
+// reloadConfig re-reads the config file on SIGHUP. Collection settings such
+// as the interval apply from the next cycle and outputs whose section
+// changed are restarted. Settings that are only read at startup keep their
+// old value and are logged as ignored. An invalid file leaves the running
+// config untouched.
+func reloadConfig(path string, out *outputs) {
+	configMu.Lock()
+	pending := applyReload(path, out)
+	configMu.Unlock()
+
+	// Starting a backend can take seconds (ping, dial), so it happens
+	// without the write lock that would block polling and HTTP requests.
+	// A backend stopped again by a newer reload is left to that one.
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for name, gen := range pending {
+		if out.generation(name) != gen {
+			continue
+		}
+		log.Printf("Config reload: starting %s", name)
+		out.start(name, false)
+	}
+}
+
+// applyReload loads the config file for reloadConfig, with configMu held
+// for writing, and stops the backends whose section changed. It returns
+// the generation of each backend that should be started again.
+func applyReload(path string, out *outputs) map[string]int {
+	prev := config
+	prevAliases := ueventAliases
+	prevMtime := configMtime
+	config = Config{}
+	if err := loadConfig(path); err != nil {
+		config = prev
+		ueventAliases = prevAliases
+		configMtime = prevMtime
+		logError("config", "Config reload failed, keeping the running config: %v", err)
+		return nil
+	}
+
+	ignored := func(key string) {
+		log.Printf("Config reload: %s can only change at startup, ignoring it until restart", key)
+	}
+	if !reflect.DeepEqual(config.Prometheus, prev.Prometheus) {
+		ignored("prometheus")
+		config.Prometheus = prev.Prometheus
+	}
+	if config.Source != prev.Source {
+		ignored("source")
+		config.Source = prev.Source
+	}
+	if config.SysfsPath != prev.SysfsPath {
+		ignored("sysfs_path")
+		config.SysfsPath = prev.SysfsPath
+	}
+	if config.Powercap != prev.Powercap {
+		ignored("powercap")
+		config.Powercap = prev.Powercap
+	}
+	if config.History.Enabled != prev.History.Enabled {
+		ignored("history.enabled")
+		config.History.Enabled = prev.History.Enabled
+	}
+	if config.Errors.Enabled != prev.Errors.Enabled {
+		ignored("errors.enabled")
+		config.Errors.Enabled = prev.Errors.Enabled
+	}
+	updateErrorSettings()
+
+	// Pushgateway pushes the Prometheus collectors, which are only set up
+	// at startup when either of them was enabled. A failed setup leaves
+	// none registered, so a later reload can try again.
+	if config.Pushgateway.Enabled && batteryGauges == nil {
+		if err := initPrometheusMetrics(); err != nil {
+			logError("config", "Config reload: cannot enable pushgateway: %v", err)
+			config.Pushgateway = prev.Pushgateway
+		}
+	}
+
+	pending := make(map[string]int)
+	for _, name := range backendNames {
+		section, enabled := backendConfig(&config, name)
+		prevSection, wasEnabled := backendConfig(&prev, name)
+		if reflect.DeepEqual(section, prevSection) {
+			continue
+		}
+		if wasEnabled {
+			log.Printf("Config reload: stopping %s", name)
+		}
+		// Also ends the retries of a backend that never came up
+		out.stop(name)
+		if enabled {
+			pending[name] = out.generation(name)
+		}
+	}
+
+	if configReloads != nil {
+		configReloads.Inc()
+	}
+	log.Printf("Config reloaded from %s (interval %s)", path, pollInterval())
+	return pending
+}
+
+// chargeDecision returns whether charging should be inhibited: from the
+// target up, not at or below the floor, and unchanged in between so the
+// pack is not toggled every cycle.
+func chargeDecision(capacity, floor, target int, inhibited bool) bool {
+	switch {
+	case capacity >= target:
+		return true
+	case capacity <= floor:
+		return false
+	}
+	return inhibited
+}
+
+// readChargeBehaviour returns the selected charge_behaviour, which sysfs
+// shows in brackets among the supported ones: "auto [inhibit-charge]".
+func readChargeBehaviour(name string) (string, bool) {
+	data, err := os.ReadFile(powerSupplyPath(name, "charge_behaviour"))
+	if err != nil {
+		return "", false
+	}
+	for _, f := range strings.Fields(string(data)) {
+		if strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]") {
+			return strings.Trim(f, "[]"), true
+		}
+	}
+	return "", false
+}
+
+// writeSysfs writes a power supply attribute.
+func writeSysfs(name, attr, value string) error {
+	return os.WriteFile(powerSupplyPath(name, attr), []byte(value), 0)
+}
+
+// chargeControlled reports whether charge_control manages the battery.
+func chargeControlled(name string) bool {
+	_, hasFloor := config.ChargeFloor[name]
+	_, hasTarget := config.ChargeTarget[name]
+	return config.ChargeControl && config.Source != "upower" && hasFloor && hasTarget
+}
+
+// releaseChargeControl sets charge_behaviour back to auto if
+// charge_control inhibited charging, so a stopped or reconfigured exporter
+// does not leave the battery refusing to charge.
+func releaseChargeControl(name string) {
+	st := stateFor(name)
+	if !st.chargeInhibited {
+		return
+	}
+	st.chargeInhibited = false
+	if current, ok := readChargeBehaviour(name); !ok || current != "inhibit-charge" {
+		return
+	}
+	if err := writeSysfs(name, "charge_behaviour", "auto"); err != nil {
+		logError("charge_control", "charge_control %s: setting charge_behaviour to auto: %v", name, err)
+		return
+	}
+	log.Printf("charge_control %s: released, charge_behaviour inhibit-charge -> auto", name)
+}
+
+// applyChargeControl keeps a battery between its charge_floor and
+// charge_target and records the decision in m. Writes only happen when
+// the current sysfs state differs, so a restart picks up where the
+// previous run left off.
+func applyChargeControl(info *BatteryInfo, m *batteryMetrics) {
+	name := info.Name
+	floor, hasFloor := config.ChargeFloor[name]
+	target, hasTarget := config.ChargeTarget[name]
+	if !hasFloor || !hasTarget {
+		return
+	}
+
+	if current, ok := readChargeBehaviour(name); ok {
+		inhibit := chargeDecision(info.Capacity, floor, target, current == "inhibit-charge")
+		want := "auto"
+		if inhibit {
+			want = "inhibit-charge"
+		}
+		if want != current {
+			if err := writeSysfs(name, "charge_behaviour", want); err != nil {
+				logError("charge_control", "charge_control %s: setting charge_behaviour to %s: %v", name, want, err)
+				return
+			}
+			log.Printf("charge_control %s: %d%%, charge_behaviour %s -> %s", name, info.Capacity, current, want)
+			m.ChargeControlWrites++
+		}
+		m.HasChargeControl = true
+		stateFor(name).chargeInhibited = inhibit
+		if inhibit {
+			m.ChargeInhibited = 1
+		}
+		return
+	}
+
+	// Threshold fallback: the firmware does the hysteresis itself. The
+	// order avoids a start threshold above the end threshold in between.
+	desired := []struct {
+		attr  string
+		value int
+	}{{"charge_control_end_threshold", target}, {"charge_control_start_threshold", floor}}
+	if start, ok := readSysfsInt(name, "charge_control_start_threshold"); ok && start >= target {
+		desired[0], desired[1] = desired[1], desired[0]
+	}
+	for _, d := range desired {
+		current, ok := readSysfsInt(name, d.attr)
+		if !ok || current == d.value {
+			continue
+		}
+		if err := writeSysfs(name, d.attr, strconv.Itoa(d.value)); err != nil {
+			logError("charge_control", "charge_control %s: setting %s to %d: %v", name, d.attr, d.value, err)
+			continue
+		}
+		log.Printf("charge_control %s: %s %d -> %d", name, d.attr, current, d.value)
+		m.ChargeControlWrites++
+	}
+}
+
+// checkLowBattery runs the low_battery command when a discharging battery
+// crosses below the threshold. The command runs in the background so a
+// slow hook (e.g. a suspend) does not hold up the polling cycle.
+func checkLowBattery(info *BatteryInfo) {
+	lb := config.LowBattery
+	if lb.Command == "" {
+		return
+	}
+	st := stateFor(info.Name)
+	if info.Capacity > lb.Percent {
+		st.lowBatteryArmed = true
+		return
+	}
+	if info.Capacity == lb.Percent {
+		return
+	}
+	if !st.lowBatteryArmed || info.Status != "Discharging" {
+		st.lowBatteryArmed = false
+		return
+	}
+	st.lowBatteryArmed = false
+
+	log.Printf("low_battery %s: %d%% is below %d%%, running %q", info.Name, info.Capacity, lb.Percent, lb.Command)
+	cmd := exec.Command("sh", "-c", lb.Command)
+	cmd.Env = append(os.Environ(),
+		"POWER_EXPORTER_BATTERY="+info.Name,
+		"POWER_EXPORTER_PERCENT="+strconv.Itoa(info.Capacity),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		logError("low_battery", "low_battery %s: %v", info.Name, err)
+		return
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logError("low_battery", "low_battery %s: %v", info.Name, err)
+		}
+	}()
+}
+
+// updateBattery reads one battery and publishes its metrics to the
+// enabled outputs. Returns nil if the battery could not be read.
+func updateBattery(batName string, out *outputs) *batteryMetrics {
+	info, err := readBatteryInfoSampled(batName)
+	if err != nil {
+		logError("read", "Error reading %s: %v", batName, err)
+		return nil
+	}
+	now := time.Now()
+	id := batteryID(info)
+	readTimesMu.Lock()
+	readTimes[batName] = now
+	prevID, seen := batteryIDs[batName]
+	batteryIDs[batName] = id
+	readTimesMu.Unlock()
+	applyDesignOverride(info)
+
+	// A pack swap changes the serial; drop the old pack's series
+	if seen && prevID != id && batteryGauges != nil {
+		deleteBatterySeries(prevID)
+	}
+
+	m := computeMetrics(info, now)
+	if tracing {
+		parsed := *info
+		if traceRedact && parsed.Serial != "" {
+			parsed.Serial = "<redacted>"
+		}
+		log.Printf("trace: %s parsed: %+v", batName, parsed)
+		log.Printf("trace: %s computed: %+v", batName, batteryFields(m))
+	}
+	if !readOnly {
+		if chargeControlled(batName) {
+			applyChargeControl(info, m)
+		} else {
+			releaseChargeControl(batName)
+		}
+		checkLowBattery(info)
+	}
+	if config.History.Enabled {
+		recordHistory(batName, m, now)
+	}
+
+	// Prometheus metrics (for both scrape and push)
+	if batteryGauges != nil {
+		g := batteryGauges
+		labels := batteryLabelValues(batName, id)
+		st := stateFor(batName)
+		g["percentage"].WithLabelValues(labels...).Set(m.Percentage)
+		g["capacity"].WithLabelValues(labels...).Set(m.CapacityHealth)
+		g["charging"].WithLabelValues(labels...).Set(m.Charging)
+		g["voltage"].WithLabelValues(labels...).Set(m.Voltage)
+		g["energy_now"].WithLabelValues(labels...).Set(m.EnergyWh)
+		g["cycle_count"].WithLabelValues(labels...).Set(float64(info.CycleCount))
+		if m.WarmedUp {
+			g["energy_since_full"].WithLabelValues(labels...).Set(m.EnergySinceFull)
+		}
+		if info.HasVoltageOCV {
+			g["voltage_ocv"].WithLabelValues(labels...).Set(m.VoltageOCV)
+		}
+		if m.Cells > 0 {
+			g["voltage_per_cell"].WithLabelValues(labels...).Set(m.VoltagePerCell)
+		}
+		if info.HasChargeCounter {
+			g["charge_counter"].WithLabelValues(labels...).Set(m.ChargeCounterAh)
+		}
+		if info.HasCapacityErrorMargin {
+			g["capacity_error_margin"].WithLabelValues(labels...).Set(float64(info.CapacityErrorMargin))
+		}
+		if m.ChargeTarget > 0 {
+			g["charge_target_reached"].WithLabelValues(labels...).Set(m.TargetReached)
+		}
+		if info.HasChargeEndThreshold {
+			g["charge_limit_end"].WithLabelValues(labels...).Set(float64(info.ChargeEndThreshold))
+		}
+		if info.HasChargeStartThreshold {
+			g["charge_limit_start"].WithLabelValues(labels...).Set(float64(info.ChargeStartThreshold))
+		}
+		if config.HealthBaseline {
+			g["health_baseline"].WithLabelValues(labels...).Set(m.HealthBaseline)
+		}
+		if m.InternalResistance >= 0 {
+			g["internal_resistance"].WithLabelValues(labels...).Set(m.InternalResistance)
+		}
+		if info.HasTemp {
+			g["temperature"].WithLabelValues(labels...).Set(float64(info.Temp) / 10.0)
+			g["thermal_throttled"].WithLabelValues(labels...).Set(m.ThermalThrottled)
+		}
+		if info.HasLearnedFull {
+			g["learned_full_capacity"].WithLabelValues(labels...).Set(info.LearnedFullWh)
+		}
+		if w, ok := batteryPower(info); ok {
+			g["power"].WithLabelValues(labels...).Set(w)
+		}
+		if m.HasChargeControl {
+			g["charge_inhibited"].WithLabelValues(labels...).Set(m.ChargeInhibited)
+		}
+		if m.ChargeControlWrites > 0 {
+			promCounters["charge_control_writes"].WithLabelValues(labels...).Add(float64(m.ChargeControlWrites))
+		}
+		if info.CapacityLevel != "" {
+			setInfoSeries(g["capacity_level"], &st.levelLabels, append(labels, info.CapacityLevel))
+			g["capacity_band"].WithLabelValues(labels...).Set(capacityBand(info.CapacityLevel))
+		}
+		setInfoSeries(g["info"], &st.infoLabels, append(labels, info.Model, info.Manufacturer, strings.TrimSpace(info.Serial), info.Technology))
+		for i, v := range info.CellVoltages {
+			g["cell_voltage"].WithLabelValues(append(labels, strconv.Itoa(i+1))...).Set(v)
+		}
+		if m.Discrepancy >= 0 {
+			g["percentage_discrepancy"].WithLabelValues(labels...).Set(m.Discrepancy)
+			g["gauge_miscalibrated"].WithLabelValues(labels...).Set(m.Miscalibrated)
+		}
+		// A stale estimate from the other direction would be misleading
+		for key, v := range map[string]float64{"time_to_empty": m.TimeToEmpty, "time_to_full": m.TimeToFull} {
+			if v >= 0 {
+				g[key].WithLabelValues(labels...).Set(v)
+			} else {
+				g[key].DeleteLabelValues(labels...)
+			}
+		}
+		if w, ok := batteryPower(info); ok && info.Status == "Discharging" {
+			promHists["power_draw"].WithLabelValues(labels...).Observe(w)
+		}
+		if info.Status != "" && m.StatusElapsed > 0 {
+			promCounters["time_in_state"].WithLabelValues(append(labels, info.Status)...).Add(m.StatusElapsed.Seconds())
+		}
+	}
+
+	// InfluxDB
+	if out.influx != nil {
+		fields := batteryFields(m)
+		tags := map[string]string{
+			"host":    config.Host,
+			"battery": id,
+		}
+		if loc := config.Locations[batName]; loc != "" {
+			tags["location"] = loc
+		}
+		if config.InfluxDB.VersionTag {
+			tags["exporter_version"] = version
+		}
+		p := influxdb2.NewPoint(
+			"battery",
+			tags,
+			renameFields(fields),
+			pointTime(now))
+		if err := out.influx.writePoint(p); err != nil {
+			logError("influxdb", "InfluxDB write error for %s: %v", batName, err)
+		}
+	}
+	return m
+}
+
+// historyEntry is one reading kept for the /history endpoint.
+type historyEntry struct {
+	Time           time.Time `json:"time"`
+	Status         string    `json:"status"`
+	Percentage     float64   `json:"percentage"`
+	CapacityHealth float64   `json:"capacity_health"`
+	Voltage        float64   `json:"voltage"`
+	EnergyWh       float64   `json:"energy_wh"`
+}
+
+func recordHistory(name string, m *batteryMetrics, now time.Time) {
+	depth := config.History.Depth
+	if depth <= 0 {
+		depth = 360
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h := append(history[name], historyEntry{
+		Time:           now,
+		Status:         m.Info.Status,
+		Percentage:     m.Percentage,
+		CapacityHealth: m.CapacityHealth,
+		Voltage:        m.Voltage,
+		EnergyWh:       m.EnergyWh,
+	})
+	if len(h) > depth {
+		h = h[len(h)-depth:]
+	}
+	history[name] = h
+}
+
+// historyHandler serves /history?battery=BAT0, or all batteries when the
+// parameter is omitted.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	var body interface{} = history
+	if bat := r.URL.Query().Get("battery"); bat != "" {
+		h, ok := history[bat]
+		if !ok {
+			http.Error(w, "unknown battery", http.StatusNotFound)
+			return
+		}
+		body = h
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// batteryFieldNames lists every field batteryFields can emit, besides the
+// numbered cell_voltage_N fields, so influxdb.field_map can be checked
+// for collisions when the config is loaded.
+var batteryFieldNames = []string{
+	"percentage", "capacity_health", "charging", "voltage", "energy_wh",
+	"cycle_count", "status", "energy_since_full", "charge_counter_ah",
+	"voltage_ocv", "voltage_per_cell", "capacity_error_margin",
+	"charge_target_reached", "capacity_health_baseline", "internal_resistance",
+	"charge_thermal_throttled", "percentage_discrepancy",
+	"gauge_miscalibrated", "learned_full_capacity_wh", "capacity_level",
+	"capacity_band", "charge_control_inhibited", "power_watts",
+	"temperature_celsius", "time_to_empty_seconds",
+	"time_to_full_seconds", "charge_limit_end", "charge_limit_start",
+}
+
+// cellVoltageField matches the per-cell fields of batteryFields.
+var cellVoltageField = regexp.MustCompile(`^cell_voltage_[0-9]+$`)
+
+// healthzHandler reports that the process is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports 200 once a battery has been read successfully
+// within the last three polling intervals, and 503 otherwise. Without
+// batteries a successful adapter read counts instead.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if ok, reason := ready(time.Now()); !ok {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ready reports whether the exporter has fresh readings at now, and why
+// not otherwise.
+func ready(now time.Time) (bool, string) {
+	window := 3 * pollInterval()
+	readTimesMu.Lock()
+	defer readTimesMu.Unlock()
+	if batteryCount == 0 {
+		if !adapterReadTime.IsZero() && now.Sub(adapterReadTime) <= window {
+			return true, ""
+		}
+		return false, fmt.Sprintf("no battery or adapter read in the last %s", window)
+	}
+	for _, t := range readTimes {
+		if now.Sub(t) <= window {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("no battery read in the last %s", window)
+}
+
+type errorEntry struct {
+	Time      time.Time `json:"time"`
+	Subsystem string    `json:"subsystem"`
+	Message   string    `json:"message"`
+}
+
+// logError logs an error and, with errors enabled, keeps it for /errors.
+// subsystem is e.g. "read", "influxdb" or "kafka".
+func logError(subsystem, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	if !errorSettings.enabled {
+		return
+	}
+	depth := errorSettings.depth
+	if depth <= 0 {
+		depth = 100
+	}
+	recentErrors = append(recentErrors, errorEntry{
+		Time:      time.Now(),
+		Subsystem: subsystem,
+		Message:   redactSecrets(msg),
+	})
+	if len(recentErrors) > depth {
+		recentErrors = recentErrors[len(recentErrors)-depth:]
+	}
+}
+
+// updateErrorSettings copies the errors section and the credentials to
+// redact from config. Called with config freshly (re)loaded.
+func updateErrorSettings() {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	errorSettings.enabled = config.Errors.Enabled
+	errorSettings.depth = config.Errors.Depth
+	errorSettings.secrets = []string{
+		config.InfluxDB.Token,
+		config.InfluxDB.Password,
+		config.Kafka.SASL.Password,
+		config.NATS.Password,
+		config.NATS.Token,
+	}
+}
+
+// urlPassword matches the password part of user:password@ in URLs.
+var urlPassword = regexp.MustCompile(`(://[^/:@\s]*:)[^@\s]*@`)
+
+// redactSecrets removes configured credentials from an error message,
+// since client libraries may echo URLs or request details. Called with
+// recentErrorsMu held.
+func redactSecrets(msg string) string {
+	for _, secret := range errorSettings.secrets {
+		if secret != "" {
+			msg = strings.ReplaceAll(msg, secret, "<redacted>")
+		}
+	}
+	return urlPassword.ReplaceAllString(msg, "${1}<redacted>@")
+}
+
+// errorsHandler serves /errors, oldest first.
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	recentErrorsMu.Lock()
+	body := append([]errorEntry{}, recentErrors...)
+	recentErrorsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// renameFields applies influxdb.field_map. Maps that would make two
+// fields collide are rejected when the config is loaded.
+func renameFields(fields map[string]interface{}) map[string]interface{} {
+	if len(config.InfluxDB.FieldMap) == 0 {
+		return fields
+	}
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if to, ok := config.InfluxDB.FieldMap[k]; ok {
+			k = to
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// expireStale removes a battery's series once it has gone stale_after
+// seconds without a successful read.
+func expireStale(name string, now time.Time) {
+	if config.StaleAfter <= 0 {
+		return
+	}
+	st := stateFor(name)
+	readTimesMu.Lock()
+	last, ok := readTimes[name]
+	id := batteryIDs[name]
+	readTimesMu.Unlock()
+	if st.stale || (ok && now.Sub(last) < time.Duration(config.StaleAfter)*time.Second) {
+		return
+	}
+	st.stale = true
+	log.Printf("%s: no successful read for %ds, removing its metrics", name, config.StaleAfter)
+	if batteryGauges != nil {
+		deleteBatterySeries(id)
+	}
+}
+
+// deleteBatterySeries removes every series labelled battery=id: the
+// gauges, the histograms, the battery counters and scrape success.
+func deleteBatterySeries(id string) {
+	labels := prometheus.Labels{"battery": id}
+	for _, g := range batteryGauges {
+		g.DeletePartialMatch(labels)
+	}
+	for _, h := range promHists {
+		h.DeletePartialMatch(labels)
+	}
+	// Adapter counters have no battery label and match nothing
+	for _, c := range promCounters {
+		c.DeletePartialMatch(labels)
+	}
+	if scrapeSuccess != nil {
+		scrapeSuccess.DeletePartialMatch(labels)
+	}
+}
+
+// setInfoSeries sets an info-style series to 1 and removes the battery's
+// previous label set when it differs, so a changed value does not linger
+// and an unchanged one never disappears between scrapes.
+func setInfoSeries(g *prometheus.GaugeVec, prev *[]string, labels []string) {
+	g.WithLabelValues(labels...).Set(1)
+	if *prev != nil && !slices.Equal(*prev, labels) {
+		g.DeleteLabelValues(*prev...)
+	}
+	*prev = slices.Clone(labels)
+}
+
+// recordReadResult updates battery_last_scrape_success. A failure only
+// counts once scrape_failure_threshold reads in a row have failed.
+func recordReadResult(name string, ok bool) {
+	st := stateFor(name)
+	if ok {
+		st.readFailures = 0
+	} else {
+		st.readFailures++
+	}
+	// A stale battery's series stay removed until it reads again
+	if scrapeSuccess == nil || (!ok && st.stale) {
+		return
+	}
+	readTimesMu.Lock()
+	id, seen := batteryIDs[name]
+	readTimesMu.Unlock()
+	if !seen {
+		id = name
+	}
+	threshold := config.ScrapeFailureThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	labels := batteryLabelValues(name, id)
+	switch {
+	case ok:
+		scrapeSuccess.WithLabelValues(labels...).Set(1)
+	case st.readFailures >= threshold:
+		scrapeSuccess.WithLabelValues(labels...).Set(0)
+	}
+}
+
+// clockOffset returns clock_offset as a duration.
+func clockOffset() time.Duration {
+	return time.Duration(config.ClockOffset * float64(time.Second))
+}
+
+// pointTime returns the timestamp to send with a point taken at t: t
+// corrected by clock_offset, or zero with server_timestamps so the
+// receiving server assigns one.
+func pointTime(t time.Time) time.Time {
+	if config.ServerTimestamps {
+		return time.Time{}
+	}
+	return t.Add(clockOffset())
+}
+
+// rescanBatteries updates the battery list every rescan_interval seconds.
+// New batteries just add label values to the shared gauges; removed ones
+// have their series deleted and are no longer polled.
+func rescanBatteries(now time.Time) {
+	interval := time.Duration(config.RescanInterval) * time.Second
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = time.Minute
+	}
+	if now.Sub(lastRescan) < interval {
+		return
+	}
+	lastRescan = now
+	found := findBatteries()
+	for _, name := range batteries {
+		if slices.Contains(found, name) {
+			continue
+		}
+		log.Printf("%s: battery disappeared, removing its metrics", name)
+		readTimesMu.Lock()
+		id, seen := batteryIDs[name]
+		readTimesMu.Unlock()
+		if !seen {
+			id = name
+		}
+		if batteryGauges != nil {
+			deleteBatterySeries(id)
+		}
+	}
+	for _, name := range found {
+		if !slices.Contains(batteries, name) {
+			log.Printf("%s: new battery found", name)
+		}
+	}
+	batteries = found
+}
+
+// collectOnce runs a single polling cycle over all batteries and adapters.
+// out may be nil when only the Prometheus gauges should be updated.
+func collectOnce(out *outputs) {
+	if out == nil {
+		out = &outputs{}
+	}
+	out = out.snapshot()
+	now := time.Now()
+	rescanBatteries(now)
+	readTimesMu.Lock()
+	batteryCount = len(batteries)
+	readTimesMu.Unlock()
+	readings := make(map[string]*batteryMetrics)
+	for _, batName := range batteries {
+		if m := updateBattery(batName, out); m != nil {
+			readings[batName] = m
+			stateFor(batName).stale = false
+			recordReadResult(batName, true)
+		} else {
+			recordReadResult(batName, false)
+			expireStale(batName, now)
+		}
+	}
+	adapterInfos := updateAdapters()
+
+	sysPower, haveSysPower := systemPower(readings, adapterInfos)
+	onBat := onBattery(readings, adapterInfos)
+	if len(systemGauges) > 0 {
+		if haveSysPower {
+			systemGauges["power"].Set(sysPower)
+		} else {
+			systemGauges["power"].Set(math.NaN())
+		}
+		if onBat {
+			systemGauges["on_battery"].Set(1)
+		} else {
+			systemGauges["on_battery"].Set(0)
+		}
+	}
+	var cpuPower map[string]float64
+	if config.Powercap {
+		cpuPower = updatePowercap(now)
+		if powercapGauge != nil {
+			for zone, w := range cpuPower {
+				powercapGauge.WithLabelValues(zone).Set(w)
+			}
+		}
+	}
+
+	if out.influx != nil {
+		for zone, w := range cpuPower {
+			p := influxdb2.NewPoint(
+				"cpu",
+				map[string]string{"host": config.Host, "zone": zone},
+				map[string]interface{}{"power_watts": w},
+				pointTime(now))
+			if err := out.influx.writePoint(p); err != nil {
+				logError("influxdb", "InfluxDB write error for cpu zone %s: %v", zone, err)
+			}
+		}
+		fields := map[string]interface{}{"on_battery": onBat}
+		if haveSysPower {
+			fields["power_watts"] = sysPower
+		}
+		p := influxdb2.NewPoint(
+			"system",
+			map[string]string{"host": config.Host},
+			fields,
+			pointTime(now))
+		if err := out.influx.writePoint(p); err != nil {
+			logError("influxdb", "InfluxDB write error for system: %v", err)
+		}
+		out.influx.flush()
+	}
+	if (out.kafka != nil || out.nats != nil) && len(readings) > 0 {
+		payload := newCyclePayload(readings, now)
+		payload.OnBattery = onBat
+		if haveSysPower {
+			payload.SystemPowerWatts = &sysPower
+		}
+		if len(cpuPower) > 0 {
+			payload.CPUPowerWatts = cpuPower
+		}
+		if out.kafka != nil {
+			if err := out.kafka.publish(payload); err != nil {
+				logError("kafka", "Kafka write error: %v", err)
+			}
+		}
+		if out.nats != nil {
+			if err := out.nats.publish(payload); err != nil {
+				logError("nats", "NATS publish error: %v", err)
+			}
+		}
+	}
+	if out.sqlite != nil && len(readings) > 0 {
+		if err := out.sqlite.insert(readings, now); err != nil {
+			logError("sqlite", "SQLite write error: %v", err)
+		}
+	}
+}
+
+// cyclePayload is the JSON message published once per cycle by the
+// message-based outputs.
+type cyclePayload struct {
+	Host      string                            `json:"host"`
+	Time      time.Time                         `json:"time"`
+	Version   string                            `json:"version"`
+	Batteries map[string]map[string]interface{} `json:"batteries"`
+	// SystemPowerWatts is omitted when it cannot be estimated.
+	SystemPowerWatts *float64 `json:"system_power_watts,omitempty"`
+	OnBattery        bool     `json:"on_battery"`
+	// CPUPowerWatts maps powercap zones to watts (see Config.Powercap).
+	CPUPowerWatts map[string]float64 `json:"cpu_power_watts,omitempty"`
+}
+
+func newCyclePayload(readings map[string]*batteryMetrics, now time.Time) *cyclePayload {
+	p := &cyclePayload{
+		Host:      config.Host,
+		Time:      now.Add(clockOffset()),
+		Version:   version,
+		Batteries: make(map[string]map[string]interface{}),
+	}
+	for name, m := range readings {
+		p.Batteries[name] = batteryFields(m)
+	}
+	return p
+}
+
+// kafkaOutput produces one JSON message per cycle, keyed by host so all
+// messages from a host land on the same partition.
+type kafkaOutput struct {
+	writer kafkaWriter
+}
+
+// kafkaWriter is the part of *kafka.Writer that kafkaOutput uses, so tests
+// can stand in for a broker.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newKafkaOutput returns nil when Kafka output is disabled.
+func newKafkaOutput() (*kafkaOutput, error) {
+	if !config.Kafka.Enabled {
+		return nil, nil
+	}
+	if len(config.Kafka.Brokers) == 0 || config.Kafka.Topic == "" {
+		return nil, fmt.Errorf("kafka: brokers and topic are required")
+	}
+
+	transport := &kafka.Transport{}
+	if config.Kafka.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	switch strings.ToLower(config.Kafka.SASL.Mechanism) {
+	case "":
+	case "plain":
+		transport.SASL = plain.Mechanism{
+			Username: config.Kafka.SASL.Username,
+			Password: config.Kafka.SASL.Password,
+		}
+	case "scram-sha-256", "scram-sha-512":
+		algo := scram.SHA256
+		if strings.HasSuffix(strings.ToLower(config.Kafka.SASL.Mechanism), "512") {
+			algo = scram.SHA512
+		}
+		mech, err := scram.Mechanism(algo, config.Kafka.SASL.Username, config.Kafka.SASL.Password)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: %w", err)
+		}
+		transport.SASL = mech
+	default:
+		return nil, fmt.Errorf("kafka: unsupported sasl mechanism %q", config.Kafka.SASL.Mechanism)
+	}
+
+	// The writer connects lazily, so dial a broker now to surface
+	// connection and auth errors at startup.
+	dialer := &kafka.Dialer{
+		Timeout:       5 * time.Second,
+		TLS:           transport.TLS,
+		SASLMechanism: transport.SASL,
+	}
+	var dialErr error
+	for _, broker := range config.Kafka.Brokers {
+		conn, err := dialer.Dial("tcp", broker)
+		if err == nil {
+			conn.Close()
+			dialErr = nil
+			break
+		}
+		dialErr = err
+	}
+	if dialErr != nil {
+		return nil, fmt.Errorf("kafka: %w", dialErr)
+	}
+
+	return &kafkaOutput{
+		writer: &kafka.Writer{
+			Addr:      kafka.TCP(config.Kafka.Brokers...),
+			Topic:     config.Kafka.Topic,
+			Balancer:  &kafka.Hash{},
+			Transport: transport,
+			// One message per cycle: send it right away instead of
+			// waiting for the default 1s batch timeout
+			BatchSize: 1,
+		},
+	}, nil
+}
+
+func (o *kafkaOutput) publish(payload *cyclePayload) error {
+	value, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg := kafka.Message{
+		Key:   []byte(config.Host),
+		Value: value,
+	}
+	// A zero Time lets the writer stamp the message on send
+	if !config.ServerTimestamps {
+		msg.Time = payload.Time
+	}
+	return o.writer.WriteMessages(ctx, msg)
+}
+
+// natsOutput publishes one JSON message per cycle. The connection
+// reconnects on its own; publishes while disconnected are buffered by the
+// client.
+type natsOutput struct {
+	conn *nats.Conn
+	js   jetstream.JetStream
+}
+
+// newNATSOutput returns nil when NATS output is disabled.
+func newNATSOutput() (*natsOutput, error) {
+	if !config.NATS.Enabled {
+		return nil, nil
+	}
+	if config.NATS.Subject == "" {
+		return nil, fmt.Errorf("nats: subject is required")
+	}
+	url := config.NATS.URL
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	opts := []nats.Option{
+		nats.Name("power-exporter " + config.Host),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logError("nats", "NATS disconnected: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Printf("NATS reconnected to %s", c.ConnectedUrl())
+		}),
+	}
+	switch {
+	case config.NATS.Credentials != "":
+		opts = append(opts, nats.UserCredentials(config.NATS.Credentials))
+	case config.NATS.Username != "":
+		opts = append(opts, nats.UserInfo(config.NATS.Username, config.NATS.Password))
+	case config.NATS.Token != "":
+		opts = append(opts, nats.Token(config.NATS.Token))
+	}
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %w", err)
+	}
+	o := &natsOutput{conn: conn}
+	if config.NATS.JetStream {
+		if o.js, err = jetstream.New(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("nats: %w", err)
+		}
+	}
+	return o, nil
+}
+
+func (o *natsOutput) publish(payload *cyclePayload) error {
+	value, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if o.js != nil {
+		// JetStream publishes wait for the stream's acknowledgement
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := o.js.Publish(ctx, config.NATS.Subject, value)
+		return err
+	}
+	return o.conn.Publish(config.NATS.Subject, value)
+}
+
+// close delivers buffered publishes and closes the connection. Drain would
+// return before it is done, and at shutdown the process exits right after.
+func (o *natsOutput) close() {
+	if err := o.conn.FlushTimeout(5 * time.Second); err != nil {
+		log.Printf("NATS flush error: %v", err)
+	}
+	o.conn.Close()
+}
+
+// sqliteOutput writes a row per battery per cycle to the battery table.
+// The table starts with the identifying columns; a column is added the
+// first time a field shows up, so optional metrics (cell voltages, charge
+// counter, ...) get one only on hardware that reports them.
+type sqliteOutput struct {
+	db      *sql.DB
+	columns map[string]bool
+}
+
+// newSQLiteOutput opens (creating if needed) the database and table.
+// Returns nil when SQLite output is disabled.
+func newSQLiteOutput() (*sqliteOutput, error) {
+	if !config.SQLite.Enabled {
+		return nil, nil
+	}
+	if config.SQLite.Path == "" {
+		return nil, fmt.Errorf("sqlite: path is required")
+	}
+	db, err := sql.Open("sqlite", config.SQLite.Path)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	// A single connection serializes writers on the file
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS battery (
+		time TEXT NOT NULL,
+		host TEXT NOT NULL,
+		battery TEXT NOT NULL,
+		location TEXT NOT NULL
+	)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: creating table: %w", err)
+	}
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('battery')`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	defer rows.Close()
+	o := &sqliteOutput{db: db, columns: make(map[string]bool)}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite: %w", err)
+		}
+		o.columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	return o, nil
+}
+
+// insert writes one row per battery in a single transaction.
+func (o *sqliteOutput) insert(readings map[string]*batteryMetrics, now time.Time) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Columns added in this transaction, so a field shared by several
+	// batteries is only added once
+	added := make(map[string]bool)
+	names := mapKeys(readings)
+	sort.Strings(names)
+	for _, name := range names {
+		m := readings[name]
+		fields := batteryFields(m)
+		keys := mapKeys(fields)
+		sort.Strings(keys)
+		cols := []string{"time", "host", "battery", "location"}
+		args := []interface{}{now.Add(clockOffset()).UTC().Format(time.RFC3339Nano), config.Host, batteryID(m.Info), config.Locations[name]}
+		for _, k := range keys {
+			if !o.columns[k] && !added[k] {
+				colType := "REAL"
+				if _, ok := fields[k].(string); ok {
+					colType = "TEXT"
+				}
+				if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE battery ADD COLUMN "%s" %s`, k, colType)); err != nil {
+					return fmt.Errorf("adding column %s: %w", k, err)
+				}
+				added[k] = true
+			}
+			cols = append(cols, `"`+k+`"`)
+			args = append(args, fields[k])
+		}
+		query := fmt.Sprintf("INSERT INTO battery (%s) VALUES (%s)",
+			strings.Join(cols, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", "))
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Only remember new columns once they are committed
+	for k := range added {
+		o.columns[k] = true
+	}
+	return nil
+}
+
+// checkPushgateway verifies the Pushgateway answers its health endpoint.
+func checkPushgateway() error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(config.Pushgateway.URL, "/") + "/-/healthy")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pushgateway health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// exporterCollectors returns all collectors created by
+// initPrometheusMetrics.
+func exporterCollectors() []prometheus.Collector {
+	var result []prometheus.Collector
+	for _, nc := range namedCollectors() {
+		result = append(result, nc.Collector)
+	}
+	return result
+}
+
+// selectGatherer limits g to the named metric families. An empty list
+// passes everything through.
+func selectGatherer(g prometheus.Gatherer, names []string) prometheus.Gatherer {
+	if len(names) == 0 {
+		return g
+	}
+	allowed := make(map[string]bool, len(names))
+	for _, n := range names {
+		allowed[n] = true
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		var result []*dto.MetricFamily
+		for _, mf := range families {
+			if allowed[mf.GetName()] {
+				result = append(result, mf)
+			}
+		}
+		return result, err
+	})
+}
+
+// labelGatherer adds a constant label to every metric gathered from g.
+func labelGatherer(g prometheus.Gatherer, name, value string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		for _, mf := range families {
+			for _, m := range mf.GetMetric() {
+				m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+				sort.Slice(m.Label, func(i, j int) bool {
+					return m.Label[i].GetName() < m.Label[j].GetName()
+				})
+			}
+		}
+		return families, err
+	})
+}
+
+// validTarget matches host or host:port values accepted for ?target=.
+var validTarget = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?(:[0-9]{1,5})?$`)
+
+// metricsHandler serves the scrape endpoint, applying the metric
+// selection and exported_instance label from the config.
+func metricsHandler() http.Handler {
+	gatherer := selectGatherer(prometheus.DefaultGatherer, config.Prometheus.Metrics)
+	instance := config.Prometheus.ExportedInstance
+	if instance == "" {
+		if len(config.Prometheus.Metrics) == 0 {
+			return promhttp.Handler()
+		}
+		return promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}),
+		)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := instance
+		if target := r.URL.Query().Get("target"); target != "" {
+			if len(target) > 253 || !validTarget.MatchString(target) {
+				http.Error(w, fmt.Sprintf("invalid target %q", target), http.StatusBadRequest)
+				return
+			}
+			value = target
+		}
+		g := labelGatherer(gatherer, "exported_instance", value)
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handler)
+}
+
+// newMux routes the metrics path and the other HTTP endpoints, all under
+// prometheus.base_path.
+func newMux() *http.ServeMux {
+	base := config.Prometheus.BasePath
+	mux := http.NewServeMux()
+	mux.Handle(base+config.Prometheus.Path, metricsHandler())
+	mux.HandleFunc(base+"/healthz", healthzHandler)
+	mux.HandleFunc(base+"/readyz", readyzHandler)
+	if config.History.Enabled {
+		mux.HandleFunc(base+"/history", historyHandler)
+	}
+	if config.Errors.Enabled {
+		mux.HandleFunc(base+"/errors", errorsHandler)
+	}
+	return mux
+}
+
+var (
+	pushRegistry     *prometheus.Registry
+	pushRegistryOnce sync.Once
+)
+
+func pushMetrics() {
+	job := config.Pushgateway.Job
+	if job == "" {
+		job = "power_exporter"
+	}
+	// The push side has its own registry so it can carry a different
+	// metric selection than the scrape endpoint.
+	pushRegistryOnce.Do(func() {
+		pushRegistry = prometheus.NewRegistry()
+		for _, c := range exporterCollectors() {
+			pushRegistry.MustRegister(c)
+		}
+	})
+	pusher := push.New(config.Pushgateway.URL, job).
+		Grouping("host", config.Host).
+		Gatherer(selectGatherer(pushRegistry, config.Pushgateway.Metrics))
+	if err := pusher.Push(); err != nil {
+		logError("pushgateway", "Pushgateway error: %v", err)
+	}
+}
+
+func pollInterval() time.Duration {
+	interval := time.Duration(config.Interval * float64(time.Second))
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	return interval
+}
+
+// shouldCollect evaluates collect_when. A command that cannot run or a
+// file that cannot be read count as false. It takes configMu itself only
+// to copy the condition, so a slow command does not hold up a reload.
+func shouldCollect() bool {
+	configMu.RLock()
+	cw := config.CollectWhen
+	configMu.RUnlock()
+	if cw.File != "" {
+		want := cw.Value
+		if want == "" {
+			want = "1"
+		}
+		data, err := os.ReadFile(cw.File)
+		if err != nil || strings.TrimSpace(string(data)) != want {
+			return false
+		}
+	}
+	if cw.Command != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := exec.CommandContext(ctx, "sh", "-c", cw.Command).Run(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// updateMetrics polls every interval until ctx is cancelled. A cycle in
+// progress is finished before it returns.
+func updateMetrics(ctx context.Context, out *outputs) {
+	paused := false
+
+	for {
+		if shouldCollect() {
+			configMu.RLock()
+			if paused {
+				log.Printf("collect_when is true, resuming collection")
+				paused = false
+			}
+			collectOnce(out)
+			if tracing {
+				log.Printf("trace: cycle complete, tracing off")
+				tracing = false
+			}
+
+			// Pushgateway
+			if out.snapshot().pushgateway {
+				pushMetrics()
+			}
+			configMu.RUnlock()
+		} else if !paused {
+			log.Printf("collect_when is false, pausing collection")
+			paused = true
+		}
+
+		// The interval is read every cycle so a reload can change it
+		configMu.RLock()
+		interval := pollInterval()
+		configMu.RUnlock()
+		if !sleepCtx(ctx, interval) {
+			return
+		}
+	}
+}
+
+// sleepCtx waits for d and reports false if ctx was cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// serveProfile serves the pprof handlers on a loopback-only port, apart
+// from the metrics listeners so they never get exposed with them.
+func serveProfile(port int) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	log.Printf("pprof at http://%s/debug/pprof/", addr)
+	if err := http.ListenAndServe(addr, profileMux()); err != nil {
+		log.Printf("pprof server: %v", err)
+	}
+}
+
+// profileMux routes the pprof handlers for serveProfile.
+func profileMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// withConfigRLock holds the config read lock while h serves a request, so a
+// reload does not change the config halfway through it.
+func withConfigRLock(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		configMu.RLock()
+		defer configMu.RUnlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// basicAuth wraps h so that requests must carry the configured username and
+// a password matching the bcrypt hash.
+func basicAuth(h http.Handler, username, passwordHash string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(pass)) == nil
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="power-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// defaultListener is the listener used when prometheus.listeners is empty.
+func defaultListener() ListenerConfig {
+	port := config.Prometheus.Port
+	if port == 0 {
+		port = 9273
+	}
+	return ListenerConfig{
+		Port:      port,
+		TLS:       config.Prometheus.TLS,
+		BasicAuth: config.Prometheus.BasicAuth,
+	}
+}
+
+// serveListeners runs one HTTP server per listener, all sharing handler.
+// If any of them fails the rest are shut down and the first error returned.
+// Cancelling ctx shuts all of them down and returns nil.
+func serveListeners(ctx context.Context, listeners []ListenerConfig, handler http.Handler) error {
+	servers := make([]*http.Server, len(listeners))
+	errCh := make(chan error, len(listeners))
+	for i, l := range listeners {
+		h := handler
+		if l.BasicAuth.Username != "" {
+			h = basicAuth(h, l.BasicAuth.Username, l.BasicAuth.Password)
+		}
+		srv := &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", l.Address, l.Port),
+			Handler: h,
+		}
+		servers[i] = srv
+
+		useTLS := l.TLS.CertFile != "" && l.TLS.KeyFile != ""
+		log.Printf("Listening on %s (tls=%t)", srv.Addr, useTLS)
+		go func() {
+			var err error
+			if useTLS {
+				err = srv.ListenAndServeTLS(l.TLS.CertFile, l.TLS.KeyFile)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			errCh <- fmt.Errorf("listener %s: %w", srv.Addr, err)
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+	return err
+}
+
+// metricUnit guesses a display unit from the metric name suffix.
+func metricUnit(name string) string {
+	units := []struct{ suffix, unit string }{
+		{"_percent", "%"},
+		{"_percentage", "%"},
+		{"_volts", "V"},
+		{"_amps", "A"},
+		{"_watts", "W"},
+		{"_wh", "Wh"},
+		{"_ah", "Ah"},
+		{"_celsius", "°C"},
+		{"_seconds", "s"},
+		{"_ohms", "Ω"},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(name, u.suffix) {
+			return u.unit
+		}
+	}
+	return ""
+}
+
+// statusRow is one metric with its value per device (battery or adapter).
+type statusRow struct {
+	name   string // family name plus any non-device labels
+	family string
+	unit   string
+	values map[string]float64
+}
+
+// gatherDeviceMetrics returns the battery and adapter metrics currently in
+// the default registry, with the sorted list of device names.
+func gatherDeviceMetrics() ([]string, []statusRow, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var devices []string
+	seen := make(map[string]bool)
+	var rows []statusRow
+	for _, mf := range families {
+		// Series with labels beyond the device (e.g. state) get their own
+		// row, named like name{state="Charging"}.
+		byName := make(map[string]*statusRow)
+		var order []string
+		for _, m := range mf.GetMetric() {
+			var device string
+			var extra []string
+			if strings.HasPrefix(mf.GetName(), "system_") {
+				device = "system"
+			}
+			if strings.HasPrefix(mf.GetName(), "cpu_") {
+				device = "cpu"
+			}
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "battery", "adapter":
+					device = lp.GetValue()
+				case "location":
+				default:
+					extra = append(extra, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+				}
+			}
+			if device == "" {
+				continue
+			}
+			var v float64
+			switch {
+			case m.GetGauge() != nil:
+				v = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				v = m.GetCounter().GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(v) {
+				continue
+			}
+			name := mf.GetName()
+			if len(extra) > 0 {
+				name += "{" + strings.Join(extra, ",") + "}"
+			}
+			rw, ok := byName[name]
+			if !ok {
+				rw = &statusRow{name: name, family: mf.GetName(), unit: metricUnit(mf.GetName()), values: make(map[string]float64)}
+				byName[name] = rw
+				order = append(order, name)
+			}
+			rw.values[device] = v
+			if !seen[device] {
+				seen[device] = true
+				devices = append(devices, device)
+			}
+		}
+		sort.Strings(order)
+		for _, name := range order {
+			rows = append(rows, *byName[name])
+		}
+	}
+	sort.Strings(devices)
+	return devices, rows, nil
+}
+
+// printStatus renders the battery and adapter metrics in the default
+// registry as a table with one column per device.
+func printStatus(w io.Writer, color bool) error {
+	devices, rows, err := gatherDeviceMetrics()
+	if err != nil {
+		return err
+	}
+	cell := func(rw statusRow, d string) string {
+		v, ok := rw.values[d]
+		if !ok {
+			return "-"
+		}
+		return strings.TrimSpace(fmt.Sprintf("%.6g %s", v, rw.unit))
+	}
+
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return "\x1b[" + code + "m" + s + "\x1b[0m"
+	}
+	widths := make([]int, len(devices)+1)
+	widths[0] = len("METRIC")
+	for i, d := range devices {
+		widths[i+1] = len(d)
+	}
+	for _, rw := range rows {
+		widths[0] = max(widths[0], len(rw.name))
+		for i, d := range devices {
+			widths[i+1] = max(widths[i+1], utf8.RuneCountInString(cell(rw, d)))
+		}
+	}
+	pad := func(s string, width int) string {
+		return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+	}
+
+	header := []string{paint("1", pad("METRIC", widths[0]))}
+	for i, d := range devices {
+		header = append(header, paint("1", pad(d, widths[i+1])))
+	}
+	fmt.Fprintln(w, strings.TrimRight(strings.Join(header, "  "), " "))
+	for _, rw := range rows {
+		line := []string{paint("36", pad(rw.name, widths[0]))}
+		for i, d := range devices {
+			line = append(line, pad(cell(rw, d), widths[i+1]))
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(line, "  "), " "))
+	}
+	return nil
+}
+
+// printDeviceMetrics writes the current device metrics in the given
+// format: "table", "json" (one object per call) or "prom" (text exposition).
+func printDeviceMetrics(w io.Writer, format string, color bool) error {
+	switch format {
+	case "", "table":
+		fmt.Fprintf(w, "# %s\n", time.Now().Format(time.RFC3339))
+		if err := printStatus(w, color); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+		return nil
+	case "json":
+		_, rows, err := gatherDeviceMetrics()
+		if err != nil {
+			return err
+		}
+		metrics := make(map[string]map[string]float64)
+		for _, rw := range rows {
+			for d, v := range rw.values {
+				if metrics[d] == nil {
+					metrics[d] = make(map[string]float64)
+				}
+				metrics[d][rw.name] = v
+			}
+		}
+		return json.NewEncoder(w).Encode(map[string]interface{}{
+			"time":    time.Now().Format(time.RFC3339),
+			"metrics": metrics,
+		})
+	case "prom":
+		_, rows, err := gatherDeviceMetrics()
+		if err != nil {
+			return err
+		}
+		wanted := make(map[string]bool)
+		for _, rw := range rows {
+			wanted[rw.family] = true
+		}
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return err
+		}
+		for _, mf := range families {
+			if wanted[mf.GetName()] {
+				if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Fprintln(w)
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (want table, json or prom)", format)
+}
+
+// tailMetrics collects and prints the metrics every polling interval
+// until ctx is cancelled.
+func tailMetrics(ctx context.Context, w io.Writer, format string, color bool) error {
+	for {
+		// Like updateMetrics, read the interval every cycle
+		configMu.RLock()
+		interval := pollInterval()
+		collectOnce(nil)
+		tracing = false
+		err := printDeviceMetrics(w, format, color)
+		configMu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if !sleepCtx(ctx, interval) {
+			return nil
+		}
+	}
+}
+
+const defaultConfig = `# Power Exporter Configuration
+
+# Polling interval in seconds (fractions allowed). Each poll reads sysfs,
+# which usually means querying the embedded controller, so very short
+# intervals cost CPU wakeups and battery. A warning is logged below
+# min_interval.
+interval: 10
+min_interval: 1
+
+# Seconds to wait for batteries to appear at startup (boot race)
+startup_wait: 0
+
+# Seconds between rescans for hot-plugged or removed batteries
+# (0 = default of 60, negative disables)
+rescan_interval: 60
+
+# Where to read battery data: sysfs (default) or upower (D-Bus service)
+source: sysfs
+
+# power_supply directory to read from, e.g. a bind-mounted host sysfs;
+# powercap zones are read from the powercap directory next to it
+sysfs_path: /sys/class/power_supply
+
+# Remove a battery's metrics after this many seconds without a successful
+# read, instead of reporting the last value forever (0 = never)
+stale_after: 0
+
+# Seconds added to emitted timestamps (InfluxDB, Kafka, SQLite and scraped
+# timestamps) on hosts whose clock is known to be off
+clock_offset: 0
+# Send InfluxDB points and Kafka messages without timestamps so the
+# server assigns them on arrival (see README for the tradeoffs)
+server_timestamps: false
+
+# Only collect while a condition holds, e.g. to save power on IoT devices:
+# command must exit 0 and/or file must read value (default "1")
+# collect_when:
+#   file: /run/power-exporter/lid_open
+#   value: "1"
+#   command: "grep -q open /proc/acpi/button/lid/LID0/state"
+
+# Consecutive failed reads before battery_last_scrape_success drops to 0,
+# so a single transient read error doesn't flap it
+scrape_failure_threshold: 1
+
+# What to do when an output (InfluxDB, Kafka, NATS, SQLite, Pushgateway) can't be reached
+# at startup: fatal (refuse to start), warn (run without it) or retry
+# (keep trying in the background)
+backend_init: retry
+
+# Hostname for metrics tagging
+host: "myhost"
+
+# Prometheus metrics server (scrape endpoint)
+prometheus:
+  enabled: true
+  port: 9273
+  path: "/metrics"
+  # Prefix for all HTTP endpoints when behind a path-stripping proxy
+  base_path: ""
+  # Attach the sysfs read time to scraped metrics instead of scrape time
+  timestamps: false
+  # Also expose battery_power_draw_watts as a native histogram
+  native_histograms: false
+  # Only serve these metrics on the scrape endpoint (empty = all)
+  # metrics: []
+  # Add exported_instance="<value>" to every metric; a ?target=host[:port]
+  # query parameter then overrides it per scrape (for proxy setups)
+  # exported_instance: ""
+  # Override the help text of individual metrics
+  # help:
+  #   battery_charging: "Battery status: 0 discharging, 1 charging, 2 full, 3 not charging"
+  # Serve over HTTPS and/or require basic auth. password is a bcrypt hash,
+  # e.g. generated with: htpasswd -nbBC 10 "" secret
+  # tls:
+  #   cert_file: "/etc/power-exporter/cert.pem"
+  #   key_file: "/etc/power-exporter/key.pem"
+  # basic_auth:
+  #   username: "prometheus"
+  #   password: "$2y$10$..."
+  # Multiple listeners serving the same metrics (overrides port, tls and
+  # basic_auth when set; each listener has its own).
+  # password is a bcrypt hash, e.g. generated with: htpasswd -nbBC 10 "" secret
+  # listeners:
+  #   - address: "127.0.0.1"
+  #     port: 9273
+  #   - address: "0.0.0.0"
+  #     port: 9274
+  #     tls:
+  #       cert_file: "/etc/power-exporter/cert.pem"
+  #       key_file: "/etc/power-exporter/key.pem"
+  #     basic_auth:
+  #       username: "prometheus"
+  #       password: "$2y$10$..."
+
+# Prometheus Pushgateway
+pushgateway:
+  enabled: false
+  url: "http://localhost:9091"
+  job: "power_exporter"
+  # Only push these metrics (empty = all), e.g. to save bandwidth
+  # metrics: ["battery_percentage", "battery_charging"]
+
+# InfluxDB push
+influxdb:
+  enabled: false
+  url: "http://localhost:8086"
+  token: "your-token"
+  org: "your-org"
+  bucket: "your-bucket"
+  # Write synchronously and log errors per point (default: async, buffered)
+  blocking: false
+  # Tag points with the exporter version (exporter_version tag)
+  version_tag: false
+  # Rename emitted fields to match existing dashboards
+  # field_map:
+  #   percentage: charge_pct
+  # Compress writes to save bandwidth on metered connections
+  gzip: false
+  # InfluxDB Enterprise write consistency: any, one, quorum or all
+  # consistency: ""
+  # InfluxDB 1.8+: set version 1 and username/password instead of
+  # token/org; bucket is "database/retention-policy" (or just "database")
+  # version: 1
+  # username: ""
+  # password: ""
+
+# Kafka: one JSON message per cycle, keyed by host
+kafka:
+  enabled: false
+  brokers: ["localhost:9092"]
+  topic: "power-exporter"
+  tls: false
+  sasl:
+    mechanism: ""  # plain, scram-sha-256 or scram-sha-512
+    username: ""
+    password: ""
+
+# NATS: one JSON message per cycle (same payload as Kafka). With
+# jetstream, publishes wait for an ack from a stream covering the subject
+nats:
+  enabled: false
+  url: "nats://localhost:4222"
+  subject: "power-exporter"
+  credentials: ""  # .creds file, or use username/password or token
+  username: ""
+  password: ""
+  token: ""
+  jetstream: false
+
+# SQLite: one row per battery per cycle in a local database file
+sqlite:
+  enabled: false
+  path: "power-exporter.db"
+
+# Median-of-N sampling to filter transient EC glitches
+sampling:
+  enabled: false
+  samples: 3
+  delay_ms: 50
+
+# Keep the last N readings per battery in memory, served as JSON at
+# /history?battery=BAT0 (requires the prometheus HTTP server)
+history:
+  enabled: false
+  depth: 360
+
+# Keep the last N errors (read failures, output write failures) in memory,
+# served as JSON at /errors with credentials redacted (requires the
+# prometheus HTTP server)
+errors:
+  enabled: false
+  depth: 100
+
+# Export battery_capacity_health_baseline_percent, the minimum health over
+# the trailing 24 hours (kept in memory, resets on restart)
+health_baseline: false
+
+# Heuristic for battery_charge_thermal_throttled (needs POWER_SUPPLY_TEMP):
+# hot and not charging, or hot and charging below min_charge_current_ma
+thermal_throttle:
+  temp_celsius: 45
+  min_charge_current_ma: 0
+
+# Set battery_gauge_miscalibrated when the reported percentage and
+# ENERGY_NOW / ENERGY_FULL differ by more than this many points; a
+# persistent gap suggests running a calibration cycle
+miscalibration_threshold: 10
+
+# Export cpu_power_watts{zone=...} for every powercap (RAPL) zone:
+# package, core, uncore, dram and psys (whole SoC) where present.
+# energy_uj is root-only on some kernels
+powercap: false
+
+# Battery label value: name (BAT0...) or serial, which stays stable when
+# names swap between boots (falls back to name without a serial)
+label_by: name
+
+# Human-friendly battery locations, exported as the location label
+# locations:
+#   BAT0: internal
+#   BAT1: ultrabay
+
+# Design capacity overrides in Wh, used when ENERGY_FULL_DESIGN is
+# missing or implausible. Charge-based batteries need VOLTAGE_MIN_DESIGN
+# to convert it to CHARGE_FULL_DESIGN
+# design_capacity_wh:
+#   BAT0: 50
+
+# Charge target per battery for battery_charge_target_reached.
+# Falls back to charge_control_end_threshold from sysfs when not set.
+# charge_target:
+#   BAT0: 80
+
+# With charge_control, keep batteries with a charge_target and a
+# charge_floor between the two: charging is inhibited (charge_behaviour)
+# at the target and allowed again at the floor (and back to auto on
+# shutdown). Without charge_behaviour the band is written to
+# charge_control_start/end_threshold instead.
+# Needs write access to /sys/class/power_supply (usually root)
+charge_control: false
+# charge_floor:
+#   BAT0: 60
+
+# Run a command (with sh -c) when a discharging battery drops below
+# percent, e.g. to suspend or notify. POWER_EXPORTER_BATTERY and
+# POWER_EXPORTER_PERCENT are set in its environment. It fires once per
+# crossing and re-arms when the battery is back above percent
+# low_battery:
+#   percent: 5
+#   command: "systemctl suspend"
+
+# Vendor-specific learned full-charge capacity log per battery, exported
+# as battery_learned_full_capacity_wh. The last number in the file is
+# used; unit is uWh (default), mWh or Wh
+# learned_capacity:
+#   BAT0:
+#     path: /sys/kernel/debug/ec/ec0/learned_fcc
+#     unit: mWh
+
+# Vendor-specific file with per-cell voltages (comma or space separated),
+# exported as battery_cell_voltage_volts{cell="1"...}; unit is uV
+# (default), mV or V
+# cell_voltages:
+#   BAT0:
+#     path: /sys/class/power_supply/BAT0/device/cell_voltages
+#     unit: mV
+
+# Last resort for firmware without standard sysfs fields: evaluate an ACPI
+# method through the acpi_call kernel module and map the returned package
+# elements, in order, to uevent keys ("" skips one). Values are multiplied
+# by scale and only fill keys missing from uevent. RISKY: evaluating the
+# wrong method can hang or misconfigure the embedded controller; check the
+# method in your DSDT first. Example for _BST (state, rate, remaining,
+# voltage):
+# acpi_call:
+#   BAT0:
+#     method: '\_SB.PCI0.LPCB.EC0.BAT0._BST'
+#     fields: [POWER_SUPPLY_STATUS, POWER_SUPPLY_POWER_NOW,
+#              POWER_SUPPLY_ENERGY_NOW, POWER_SUPPLY_VOLTAGE_NOW]
+#     scale: 1000
+
+# Map non-standard vendor uevent keys to a known field or POWER_SUPPLY_* key
+# uevent_keys:
+#   VENDOR_BATT_SOC: Capacity
+
+# Series cell count per battery for battery_voltage_per_cell_volts.
+# Inferred from the design voltage when not set.
+# cell_count:
+#   BAT0: 3
+`
+
+const systemdUnitTemplate = `[Unit]
+Description=Power Exporter - Exports power/energy metrics to Prometheus
+Documentation=https://github.com/coolerUA/power-exporter
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s -c %s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func installSystemd(binPath, configPath string) error {
+	// Get current executable
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	// Copy binary to destination
+	binData, err := os.ReadFile(exe)
+	if err != nil {
+		return fmt.Errorf("failed to read binary: %w", err)
+	}
+	if err := os.WriteFile(binPath, binData, 0755); err != nil {
+		return fmt.Errorf("failed to write binary to %s: %w", binPath, err)
+	}
+	fmt.Printf("Binary installed to %s\n", binPath)
+
+	// Generate config if not exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if err := os.WriteFile(configPath, []byte(defaultConfig), 0644); err != nil {
+			return fmt.Errorf("failed to write config: %w", err)
+		}
+		fmt.Printf("Config created at %s\n", configPath)
+	} else {
+		fmt.Printf("Config already exists at %s\n", configPath)
 	}
 
 	// Create systemd unit
@@ -517,6 +5025,12 @@ func main() {
 	installConfigPath := flag.String("config", "/usr/local/etc/power-exporter.yml", "Config path for installation")
 	showVersion := flag.Bool("version", false, "Show version")
 	update := flag.Bool("update", false, "Update to latest version")
+	status := flag.Bool("status", false, "Print current metrics as a table and exit")
+	tail := flag.Bool("tail", false, "Print metrics to stdout every interval")
+	trace := flag.Bool("trace", false, "Log raw sysfs reads and computed values for the first cycle")
+	traceRedactSerial := flag.Bool("trace-redact", false, "Redact battery serial numbers in -trace output")
+	tailFormat := flag.String("tail-format", "table", "Output format for -tail: table, json or prom")
+	profilePort := flag.Int("profile", 0, "Serve net/http/pprof on this localhost port (0 = off)")
 	flag.Parse()
 
 	if *showVersion {
@@ -546,36 +5060,111 @@ func main() {
 		return
 	}
 
+	tracing = *trace
+	traceRedact = *traceRedactSerial
+
 	if err := loadConfig(*configPath); err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		// -status and -tail work without a config file, using defaults
+		if !(*status || *tail) || !os.IsNotExist(err) {
+			log.Fatalf("Failed to load config: %v", err)
+		}
 	}
 
-	batteries = findBatteries()
-	if len(batteries) == 0 {
-		log.Fatal("No batteries found")
+	batteries = waitForBatteries(time.Duration(config.StartupWait) * time.Second)
+	lastRescan = time.Now()
+	if config.Source != "upower" {
+		adapters = findAdapters()
+	}
+	// A desktop has no battery but can still report its adapter
+	if len(batteries) == 0 && len(adapters) == 0 {
+		log.Fatal("No batteries or adapters found")
+	}
+	if len(batteries) > 0 {
+		log.Printf("Found batteries: %v", batteries)
+	} else {
+		log.Printf("No batteries found, monitoring adapters only")
+	}
+	if len(adapters) > 0 {
+		log.Printf("Found adapters: %v", adapters)
+	}
+
+	if *status || *tail {
+		readOnly = true
+		if err := initPrometheusMetrics(); err != nil {
+			log.Fatalf("Failed to set up metrics: %v", err)
+		}
+		fi, err := os.Stdout.Stat()
+		color := err == nil && fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("NO_COLOR") == ""
+		if *tail {
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			if err := tailMetrics(ctx, os.Stdout, *tailFormat, color); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		collectOnce(nil)
+		if err := printStatus(os.Stdout, color); err != nil {
+			log.Fatalf("Failed to print status: %v", err)
+		}
+		return
 	}
-	log.Printf("Found batteries: %v", batteries)
 
 	if config.Prometheus.Enabled || config.Pushgateway.Enabled {
-		initPrometheusMetrics()
+		if err := initPrometheusMetrics(); err != nil {
+			log.Fatalf("Failed to set up metrics: %v", err)
+		}
 	}
 
-	go updateMetrics()
+	if *profilePort > 0 {
+		go serveProfile(*profilePort)
+	}
 
-	if config.Prometheus.Enabled {
-		path := config.Prometheus.Path
-		if path == "" {
-			path = "/metrics"
+	// Stop polling on SIGINT/SIGTERM (e.g. systemctl stop), then flush
+	// and close the outputs so buffered points are not lost
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	out, err := initOutputs(ctx)
+	if err != nil {
+		log.Fatalf("Failed to initialize %v", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP received, reloading %s", *configPath)
+			reloadConfig(*configPath, out)
 		}
-		port := config.Prometheus.Port
-		if port == 0 {
-			port = 9273
+	}()
+
+	polling := make(chan struct{})
+	go func() {
+		updateMetrics(ctx, out)
+		close(polling)
+	}()
+	var serveErr error
+
+	if config.Prometheus.Enabled {
+		listeners := config.Prometheus.Listeners
+		if len(listeners) == 0 {
+			listeners = []ListenerConfig{defaultListener()}
 		}
-		http.Handle(path, promhttp.Handler())
-		log.Printf("Prometheus metrics at :%d%s", port, path)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+		log.Printf("Prometheus metrics at %s%s", config.Prometheus.BasePath, config.Prometheus.Path)
+		serveErr = serveListeners(ctx, listeners, withConfigRLock(newMux()))
 	} else {
 		// Keep running even without prometheus
-		select {}
+		<-ctx.Done()
+	}
+
+	stop()
+	log.Printf("Shutting down")
+	<-polling
+	for name := range batStates {
+		releaseChargeControl(name)
+	}
+	out.close()
+	if serveErr != nil {
+		log.Fatal(serveErr)
 	}
 }
@@ -0,0 +1,2821 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withConfig replaces the global config for the duration of a test.
+func withConfig(t *testing.T, c Config) {
+	t.Helper()
+	prev := config
+	config = c
+	t.Cleanup(func() { config = prev })
+}
+
+// resetBatteryState gives a test fresh per-battery state.
+func resetBatteryState(t *testing.T) {
+	t.Helper()
+	prev := batStates
+	batStates = make(map[string]*batteryState)
+	t.Cleanup(func() { batStates = prev })
+}
+
+// withBatteries makes names the polled batteries, with no adapters and no
+// read history, for the duration of a test.
+func withBatteries(t *testing.T, names ...string) {
+	t.Helper()
+	prevBatteries, prevAdapters := batteries, adapters
+	prevTimes, prevIDs, prevCount := readTimes, batteryIDs, batteryCount
+	t.Cleanup(func() {
+		batteries, adapters = prevBatteries, prevAdapters
+		readTimes, batteryIDs, batteryCount = prevTimes, prevIDs, prevCount
+	})
+	batteries, adapters = names, nil
+	readTimes = make(map[string]time.Time)
+	batteryIDs = make(map[string]string)
+}
+
+// fakeSysfs writes files (e.g. "BAT0/uevent") under a temporary
+// power_supply directory and returns it.
+func fakeSysfs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// initTestMetrics runs initPrometheusMetrics against a fresh default
+// registry, which it returns, and restores the previous metrics after the
+// test.
+func initTestMetrics(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	prevReg, prevGatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	prevGauges, prevCounters, prevAdapter, prevSystem, prevHists := batteryGauges, promCounters, adapterGauges, systemGauges, promHists
+	prevScrape, prevMtime, prevReloads, prevPowercap := scrapeSuccess, configMtimeGauge, configReloads, powercapGauge
+	t.Cleanup(func() {
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = prevReg, prevGatherer
+		batteryGauges, promCounters, adapterGauges, systemGauges, promHists = prevGauges, prevCounters, prevAdapter, prevSystem, prevHists
+		scrapeSuccess, configMtimeGauge, configReloads, powercapGauge = prevScrape, prevMtime, prevReloads, prevPowercap
+	})
+
+	reg := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer, prometheus.DefaultGatherer = reg, reg
+	if err := initPrometheusMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// findFamily gathers g and returns the metric family called name, or nil.
+func findFamily(t *testing.T, g prometheus.Gatherer, name string) *dto.MetricFamily {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// loadTestConfig loads yml through loadConfig, with its defaults and
+// validation, as the config for the duration of a test.
+func loadTestConfig(t *testing.T, yml string) {
+	t.Helper()
+	cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+	if err := os.WriteFile(cfg, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, Config{})
+	if err := loadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get serves a GET of target on h.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInfluxWriteTimeout(t *testing.T) {
+	tests := []struct {
+		interval float64
+		want     time.Duration
+	}{
+		{0, 5 * time.Second}, // default 10s interval
+		{2, time.Second},
+		{1, time.Second}, // never below a second
+		{60, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		withConfig(t, Config{Interval: tt.interval})
+		if got := influxWriteTimeout(); got != tt.want {
+			t.Errorf("interval %v: influxWriteTimeout() = %v, want %v", tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestMedianInt(t *testing.T) {
+	tests := []struct {
+		vals []int
+		want int
+	}{
+		{[]int{5}, 5},
+		{[]int{3, 1, 2}, 2},
+		{[]int{10, 0, 12, 11}, 10},
+	}
+	for _, tt := range tests {
+		if got := medianInt(tt.vals); got != tt.want {
+			t.Errorf("medianInt(%v) = %d, want %d", tt.vals, got, tt.want)
+		}
+	}
+}
+
+func TestMedianInfoDropsOutlier(t *testing.T) {
+	samples := []*BatteryInfo{
+		{Status: "Discharging", Capacity: 54, EnergyNow: 27000000, VoltageNow: 11900000},
+		// A garbage read from the EC
+		{Status: "Discharging", Capacity: 0, EnergyNow: 65535000000, VoltageNow: 11800000},
+		{Status: "Charging", Capacity: 55, EnergyNow: 27100000, VoltageNow: 12000000},
+	}
+	got := medianInfo(samples)
+	if got.Capacity != 54 || got.EnergyNow != 27100000 || got.VoltageNow != 11900000 {
+		t.Errorf("capacity %d, energy %d, voltage %d; want 54, 27100000, 11900000", got.Capacity, got.EnergyNow, got.VoltageNow)
+	}
+	if got.Status != "Charging" {
+		t.Errorf("status = %q, want the last reading's Charging", got.Status)
+	}
+	// The samples themselves are left alone
+	if samples[2].Capacity != 55 {
+		t.Errorf("last sample modified: capacity %d", samples[2].Capacity)
+	}
+}
+
+func TestEnergySinceFullGap(t *testing.T) {
+	withConfig(t, Config{Interval: 10})
+	resetBatteryState(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	info := &BatteryInfo{Name: "BAT0", Status: "Discharging", EnergyNow: 40000000, PowerNow: 10000000, HasPowerNow: true}
+
+	updateEnergySinceFull(info, start)
+	// One poll at 10 W: 10 W × 10 s
+	got := updateEnergySinceFull(info, start.Add(10*time.Second))
+	if want := 10.0 * 10 / 3600; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("after one poll = %v Wh, want %v", got, want)
+	}
+
+	// An 8 h suspend only adds what ENERGY_NOW actually dropped
+	info.EnergyNow -= 1000000
+	got2 := updateEnergySinceFull(info, start.Add(8*time.Hour))
+	if diff := got2 - got; math.Abs(diff-1) > 1e-9 {
+		t.Errorf("after a gap added %v Wh, want 1", diff)
+	}
+}
+
+func TestEnergySinceFullResetsOnFull(t *testing.T) {
+	withConfig(t, Config{Interval: 10})
+	resetBatteryState(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	info := &BatteryInfo{Name: "BAT0", Status: "Discharging", EnergyNow: 40000000, PowerNow: 36000000, HasPowerNow: true}
+
+	updateEnergySinceFull(info, start)
+	if got := updateEnergySinceFull(info, start.Add(10*time.Second)); got <= 0 {
+		t.Fatalf("before Full = %v Wh, want > 0", got)
+	}
+
+	info.Status = "Full"
+	if got := updateEnergySinceFull(info, start.Add(20*time.Second)); got != 0 {
+		t.Fatalf("on Full = %v Wh, want 0", got)
+	}
+
+	// 36 W for two polls of 10s each: 0.1 Wh apiece
+	info.Status = "Discharging"
+	updateEnergySinceFull(info, start.Add(30*time.Second))
+	got := updateEnergySinceFull(info, start.Add(40*time.Second))
+	if want := 0.2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("after discharging again = %v Wh, want %v", got, want)
+	}
+}
+
+func TestCountAdapterEvent(t *testing.T) {
+	prevOnline, prevCounters := adapterOnline, promCounters
+	t.Cleanup(func() { adapterOnline, promCounters = prevOnline, prevCounters })
+	adapterOnline = make(map[string]bool)
+	promCounters = map[string]*prometheus.CounterVec{
+		"ac_plug":   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ac_plug_events_total", Help: "test"}, []string{"adapter"}),
+		"ac_unplug": prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ac_unplug_events_total", Help: "test"}, []string{"adapter"}),
+	}
+	counts := func() (float64, float64) {
+		return testutil.ToFloat64(promCounters["ac_plug"].WithLabelValues("AC")),
+			testutil.ToFloat64(promCounters["ac_unplug"].WithLabelValues("AC"))
+	}
+
+	// The first observation creates both series at 0 without counting
+	countAdapterEvent(&AdapterInfo{Name: "AC", Online: true})
+	if n := testutil.CollectAndCount(promCounters["ac_plug"]) + testutil.CollectAndCount(promCounters["ac_unplug"]); n != 2 {
+		t.Fatalf("%d series after the first observation, want 2", n)
+	}
+	if plug, unplug := counts(); plug != 0 || unplug != 0 {
+		t.Fatalf("plug %v, unplug %v after the first observation, want 0, 0", plug, unplug)
+	}
+
+	for _, online := range []bool{true, false, false, true, false} {
+		countAdapterEvent(&AdapterInfo{Name: "AC", Online: online})
+	}
+	if plug, unplug := counts(); plug != 1 || unplug != 2 {
+		t.Errorf("plug %v, unplug %v, want 1, 2", plug, unplug)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	loadTestConfig(t, "prometheus:\n  base_path: /power/\n")
+	mux := newMux()
+	for _, path := range []string{"/power/metrics", "/power/healthz", "/power/readyz"} {
+		if rec := get(mux, path); rec.Code == http.StatusNotFound {
+			t.Errorf("GET %s = 404", path)
+		}
+	}
+	for _, path := range []string{"/metrics", "/healthz", "/readyz"} {
+		if rec := get(mux, path); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestCellCount(t *testing.T) {
+	withConfig(t, Config{CellCount: map[string]int{"BAT1": 4}})
+	tests := []struct {
+		info *BatteryInfo
+		want int
+	}{
+		{&BatteryInfo{Name: "BAT0", Technology: "Li-ion", VoltageMinDesign: 11400000}, 3},
+		{&BatteryInfo{Name: "BAT0", VoltageMaxDesign: 7600000}, 2},
+		{&BatteryInfo{Name: "BAT1", Technology: "Li-ion", VoltageMinDesign: 11400000}, 4},
+		{&BatteryInfo{Name: "BAT0", Technology: "NiMH", VoltageMinDesign: 7200000}, 0},
+		{&BatteryInfo{Name: "BAT0", Technology: "Li-poly"}, 0},
+	}
+	for _, tt := range tests {
+		if got := cellCount(tt.info); got != tt.want {
+			t.Errorf("cellCount(%+v) = %d, want %d", *tt.info, got, tt.want)
+		}
+	}
+
+	resetBatteryState(t)
+	m := computeMetrics(&BatteryInfo{Name: "BAT0", VoltageNow: 12300000, VoltageMinDesign: 11400000}, time.Now())
+	if m.Cells != 3 || math.Abs(m.VoltagePerCell-4.1) > 1e-9 {
+		t.Errorf("cells %d, voltage per cell %v; want 3, 4.1", m.Cells, m.VoltagePerCell)
+	}
+}
+
+func TestInfluxVersionTag(t *testing.T) {
+	f := &fakeInflux{}
+	o := newTestInflux(t, f, true)
+	resetBatteryState(t)
+	config.SysfsPath = fakeSysfs(t, map[string]string{"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_CAPACITY=50\n"})
+	out := &outputs{influx: o}
+
+	updateBattery("BAT0", out)
+	config.InfluxDB.VersionTag = true
+	updateBattery("BAT0", out)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.bodies) != 2 {
+		t.Fatalf("%d writes, want 2", len(f.bodies))
+	}
+	if strings.Contains(f.bodies[0], "exporter_version=") {
+		t.Errorf("tagged with version_tag off: %q", f.bodies[0])
+	}
+	if !strings.Contains(f.bodies[1], "exporter_version="+version) {
+		t.Errorf("not tagged with version_tag on: %q", f.bodies[1])
+	}
+}
+
+// freePort returns a loopback port that was free a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeListeners(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, authed := freePort(t), freePort(t)
+	listeners := []ListenerConfig{
+		{Address: "127.0.0.1", Port: plain},
+		{Address: "127.0.0.1", Port: authed, BasicAuth: BasicAuthConfig{Username: "prom", Password: string(hash)}},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- serveListeners(ctx, listeners, handler) }()
+
+	status := func(port int, user, pass string) int {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		for i := 0; i < 50; i++ {
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("port %d never answered", port)
+		return 0
+	}
+	if got := status(plain, "", ""); got != http.StatusOK {
+		t.Errorf("plain listener = %d, want 200", got)
+	}
+	if got := status(authed, "", ""); got != http.StatusUnauthorized {
+		t.Errorf("auth listener without credentials = %d, want 401", got)
+	}
+	if got := status(authed, "prom", "wrong"); got != http.StatusUnauthorized {
+		t.Errorf("auth listener with a wrong password = %d, want 401", got)
+	}
+	if got := status(authed, "prom", "secret"); got != http.StatusOK {
+		t.Errorf("auth listener with credentials = %d, want 200", got)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("serveListeners after cancel = %v, want nil", err)
+	}
+}
+
+func TestLocationLabel(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_CAPACITY=50\n",
+		"BAT1/uevent": "POWER_SUPPLY_CAPACITY=70\n",
+	})
+	withConfig(t, Config{SysfsPath: root, Locations: map[string]string{"BAT0": "front bay"}})
+	resetBatteryState(t)
+	initTestMetrics(t)
+	out := &outputs{}
+
+	updateBattery("BAT0", out)
+	updateBattery("BAT1", out)
+	if got := testutil.ToFloat64(batteryGauges["percentage"].WithLabelValues("BAT0", "front bay")); got != 50 {
+		t.Errorf("BAT0 in the front bay = %v, want 50", got)
+	}
+	// Batteries without a location get an empty label
+	if got := testutil.ToFloat64(batteryGauges["percentage"].WithLabelValues("BAT1", "")); got != 70 {
+		t.Errorf("BAT1 without a location = %v, want 70", got)
+	}
+	if n := testutil.CollectAndCount(batteryGauges["percentage"]); n != 2 {
+		t.Errorf("%d percentage series, want 2", n)
+	}
+}
+
+func TestWaitForBatteries(t *testing.T) {
+	root := t.TempDir()
+	withConfig(t, Config{SysfsPath: root})
+
+	// Nothing there and no wait
+	if got := waitForBatteries(0); len(got) != 0 {
+		t.Fatalf("waitForBatteries(0) = %v, want none", got)
+	}
+
+	// The battery shows up after the first attempt
+	time.AfterFunc(200*time.Millisecond, func() {
+		os.MkdirAll(filepath.Join(root, "BAT0"), 0755)
+		os.WriteFile(filepath.Join(root, "BAT0", "uevent"), []byte("POWER_SUPPLY_CAPACITY=50\n"), 0644)
+	})
+	start := time.Now()
+	got := waitForBatteries(10 * time.Second)
+	if len(got) != 1 || got[0] != "BAT0" {
+		t.Fatalf("waitForBatteries = %v, want [BAT0]", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v after the battery appeared", elapsed)
+	}
+}
+
+func TestNormalizeHTTPPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"/metrics", "/metrics", true},
+		{"metrics", "/metrics", true},
+		{"/power/metrics", "/power/metrics", true},
+		{"/met rics", "", false},
+		{"/metrics\n", "", false},
+		{"/metrics?x=1", "", false},
+		{"/metrics#top", "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeHTTPPath(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("normalizeHTTPPath(%q) = %q, %v; want %q, ok %t", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+
+	// The metrics path must not shadow the other endpoints
+	for _, path := range []string{"/", "healthz", "/readyz", "/history", "/errors", "/metrics?x"} {
+		cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+		if err := os.WriteFile(cfg, []byte("prometheus:\n  path: \""+path+"\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		withConfig(t, Config{})
+		if err := loadConfig(cfg); err == nil {
+			t.Errorf("prometheus.path %q accepted", path)
+		}
+	}
+}
+
+func TestMetricTimestamps(t *testing.T) {
+	prevTimes, prevIDs := readTimes, batteryIDs
+	t.Cleanup(func() { readTimes, batteryIDs = prevTimes, prevIDs })
+	read := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	readTimes = map[string]time.Time{"BAT0": read}
+	batteryIDs = map[string]string{"BAT0": "BAT0"}
+
+	for _, timestamps := range []bool{false, true} {
+		var c Config
+		c.Prometheus.Timestamps = timestamps
+		withConfig(t, c)
+		reg := initTestMetrics(t)
+		batteryGauges["percentage"].WithLabelValues("BAT0", "").Set(50)
+		// Batteries that were never read keep the scrape time
+		batteryGauges["percentage"].WithLabelValues("BAT9", "").Set(10)
+
+		f := findFamily(t, reg, "battery_percentage")
+		if f == nil || len(f.GetMetric()) != 2 {
+			t.Fatalf("timestamps %t: battery_percentage = %v", timestamps, f)
+		}
+		for _, m := range f.GetMetric() {
+			want := int64(0)
+			if timestamps && m.GetLabel()[0].GetValue() == "BAT0" {
+				want = read.UnixMilli()
+			}
+			if got := m.GetTimestampMs(); got != want {
+				t.Errorf("timestamps %t: %s timestamp = %d, want %d", timestamps, m.GetLabel()[0].GetValue(), got, want)
+			}
+		}
+	}
+}
+
+func TestDesignOverride(t *testing.T) {
+	withConfig(t, Config{DesignCapacityWh: map[string]float64{"BAT0": 48}})
+	resetBatteryState(t)
+
+	// A missing design capacity is replaced
+	info := &BatteryInfo{Name: "BAT0", EnergyFull: 45000000}
+	applyDesignOverride(info)
+	if info.EnergyDesign != 48000000 {
+		t.Errorf("EnergyDesign = %d µWh, want 48000000", info.EnergyDesign)
+	}
+
+	// A plausible one is kept
+	info = &BatteryInfo{Name: "BAT0", EnergyFull: 45000000, EnergyDesign: 50000000}
+	applyDesignOverride(info)
+	if info.EnergyDesign != 50000000 {
+		t.Errorf("EnergyDesign = %d µWh, want the reported 50000000", info.EnergyDesign)
+	}
+}
+
+// fakeInflux is an InfluxDB stand-in recording write requests.
+type fakeInflux struct {
+	mu     sync.Mutex
+	writes []*http.Request
+	bodies []string
+	hang   chan struct{} // when set, writes block until it is closed
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/ping":
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/write":
+		if f.hang != nil {
+			select {
+			case <-f.hang:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.writes = append(f.writes, r)
+		f.bodies = append(f.bodies, string(body))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestInflux(t *testing.T, f *fakeInflux, blocking bool) *influxOutput {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	var c Config
+	c.Interval = 2
+	c.InfluxDB.Enabled = true
+	c.InfluxDB.URL = srv.URL
+	c.InfluxDB.Token = "token"
+	c.InfluxDB.Org = "org"
+	c.InfluxDB.Bucket = "bucket"
+	c.InfluxDB.Blocking = blocking
+	withConfig(t, c)
+	o, err := newInfluxOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(o.client.Close)
+	return o
+}
+
+func testPoint() *write.Point {
+	return influxdb2.NewPoint("battery",
+		map[string]string{"battery": "BAT0"},
+		map[string]interface{}{"percentage": 55.0},
+		time.Unix(1700000000, 0))
+}
+
+func TestInfluxBlockingWrite(t *testing.T) {
+	f := &fakeInflux{}
+	o := newTestInflux(t, f, true)
+	if err := o.writePoint(testPoint()); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.bodies) != 1 || !strings.HasPrefix(f.bodies[0], "battery,battery=BAT0 percentage=55") {
+		t.Fatalf("writes = %q", f.bodies)
+	}
+	if q := f.writes[0].URL.Query(); q.Get("org") != "org" || q.Get("bucket") != "bucket" {
+		t.Errorf("query = %v", q)
+	}
+}
+
+func TestInfluxAsyncWrite(t *testing.T) {
+	f := &fakeInflux{}
+	o := newTestInflux(t, f, false)
+	if err := o.writePoint(testPoint()); err != nil {
+		t.Fatal(err)
+	}
+	// Async points are buffered until flushed
+	o.flush()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.bodies) != 1 || !strings.HasPrefix(f.bodies[0], "battery,battery=BAT0 percentage=55") {
+		t.Fatalf("writes = %q", f.bodies)
+	}
+}
+
+func TestInfluxBlockingWriteTimeout(t *testing.T) {
+	f := &fakeInflux{hang: make(chan struct{})}
+	o := newTestInflux(t, f, true)
+	t.Cleanup(func() { close(f.hang) })
+
+	start := time.Now()
+	if err := o.writePoint(testPoint()); err == nil {
+		t.Fatal("write to a hanging server succeeded")
+	}
+	// Interval 2s: the write gives up after 1s, well before the
+	// client's own 20s timeout
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("write took %v", elapsed)
+	}
+}
+
+func TestTypecAdapterRanges(t *testing.T) {
+	const usbc = "ucsi-source-psy-USBC000:001"
+	root := fakeSysfs(t, map[string]string{
+		usbc + "/uevent": "POWER_SUPPLY_NAME=" + usbc + "\n" +
+			"POWER_SUPPLY_TYPE=USB\n" +
+			"POWER_SUPPLY_ONLINE=1\n" +
+			"POWER_SUPPLY_VOLTAGE_MAX=20000000\n" +
+			"POWER_SUPPLY_CURRENT_MAX=3250000\n",
+		"hidpp_battery_0/uevent": "POWER_SUPPLY_TYPE=Battery\n",
+		"BAT0/uevent":            "POWER_SUPPLY_TYPE=Battery\n",
+	})
+	withConfig(t, Config{SysfsPath: root})
+	initTestMetrics(t)
+	prevAdapters, prevOnline, prevRead := adapters, adapterOnline, adapterReadTime
+	t.Cleanup(func() { adapters, adapterOnline, adapterReadTime = prevAdapters, prevOnline, prevRead })
+	adapterOnline = make(map[string]bool)
+
+	adapters = findAdapters()
+	if len(adapters) != 1 || adapters[0] != usbc {
+		t.Fatalf("findAdapters() = %v, want [%s]", adapters, usbc)
+	}
+	updateAdapters()
+	if got := testutil.ToFloat64(adapterGauges["max_voltage"].WithLabelValues(usbc)); got != 20 {
+		t.Errorf("max voltage = %v V, want 20", got)
+	}
+	if got := testutil.ToFloat64(adapterGauges["max_current"].WithLabelValues(usbc)); got != 3.25 {
+		t.Errorf("max current = %v A, want 3.25", got)
+	}
+
+	// Unplugged, the port no longer advertises a contract
+	if err := os.WriteFile(filepath.Join(root, usbc, "uevent"), []byte("POWER_SUPPLY_TYPE=USB\nPOWER_SUPPLY_ONLINE=0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updateAdapters()
+	if n := testutil.CollectAndCount(adapterGauges["max_voltage"]) + testutil.CollectAndCount(adapterGauges["max_current"]); n != 0 {
+		t.Errorf("%d capability series after unplugging, want 0", n)
+	}
+	if got := testutil.ToFloat64(adapterGauges["online"].WithLabelValues(usbc)); got != 0 {
+		t.Errorf("online = %v after unplugging, want 0", got)
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	withConfig(t, Config{})
+	initTestMetrics(t)
+	batteryGauges["percentage"].WithLabelValues("BAT0", "").Set(55)
+	batteryGauges["percentage"].WithLabelValues("BAT1", "").Set(100)
+	batteryGauges["voltage"].WithLabelValues("BAT0", "").Set(11.9)
+	adapterGauges["online"].WithLabelValues("AC").Set(1)
+
+	var buf strings.Builder
+	if err := printStatus(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	want := `METRIC                 AC  BAT0    BAT1   system
+battery_percentage     -   55 %    100 %  -
+battery_voltage_volts  -   11.9 V  -      -
+power_adapter_online   1   -       -      -
+system_on_battery      -   -       -      0
+system_power_watts     -   -       -      0 W
+`
+	if got := buf.String(); got != want {
+		t.Errorf("table:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := printStatus(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "\x1b[1mMETRIC") {
+		t.Errorf("colored table starts %q, want a bold header", buf.String()[:20])
+	}
+}
+
+func TestChargeTargetReached(t *testing.T) {
+	withConfig(t, Config{ChargeTarget: map[string]int{"BAT0": 80}})
+	resetBatteryState(t)
+	tests := []struct {
+		info   *BatteryInfo
+		target int
+		want   float64
+	}{
+		{&BatteryInfo{Name: "BAT0", Capacity: 79}, 80, 0},
+		{&BatteryInfo{Name: "BAT0", Capacity: 80}, 80, 1},
+		{&BatteryInfo{Name: "BAT0", Capacity: 95}, 80, 1},
+		// The configured target wins over the firmware threshold
+		{&BatteryInfo{Name: "BAT0", Capacity: 70, ChargeEndThreshold: 60, HasChargeEndThreshold: true}, 80, 0},
+		// Without one, the end threshold is the target
+		{&BatteryInfo{Name: "BAT1", Capacity: 60, ChargeEndThreshold: 60, HasChargeEndThreshold: true}, 60, 1},
+		{&BatteryInfo{Name: "BAT1", Capacity: 100}, 0, 0},
+	}
+	for _, tt := range tests {
+		m := computeMetrics(tt.info, time.Now())
+		if m.ChargeTarget != tt.target || m.TargetReached != tt.want {
+			t.Errorf("%s at %d%%: target %d, reached %v; want %d, %v", tt.info.Name, tt.info.Capacity, m.ChargeTarget, m.TargetReached, tt.target, tt.want)
+		}
+	}
+}
+
+// cycleWriter counts the writes of tailMetrics, one per cycle in json
+// format, and calls onCycle after each.
+type cycleWriter struct {
+	mu      sync.Mutex
+	cycles  int
+	onCycle func(n int)
+}
+
+func (w *cycleWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.cycles++
+	n := w.cycles
+	w.mu.Unlock()
+	w.onCycle(n)
+	return len(p), nil
+}
+
+func (w *cycleWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cycles
+}
+
+func TestTailMetrics(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"BAT0/uevent": "POWER_SUPPLY_CAPACITY=50\n"})
+	withConfig(t, Config{SysfsPath: root, Interval: 0.01, RescanInterval: -1})
+	resetBatteryState(t)
+	initTestMetrics(t)
+	prevBatteries := batteries
+	t.Cleanup(func() { batteries = prevBatteries })
+	batteries = []string{"BAT0"}
+
+	// The second cycle comes after the short interval and picks up the
+	// long one for the next
+	w := &cycleWriter{onCycle: func(n int) {
+		if n == 1 {
+			config.Interval = 3600
+		}
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tailMetrics(ctx, w, "json", false) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := w.count(); n != 2 {
+		t.Fatalf("%d cycles, want 2", n)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("tailMetrics = %v, want nil after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tailMetrics kept sleeping after cancel")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	var c Config
+	c.Prometheus.Path = "/metrics"
+	c.History.Enabled = true
+	c.History.Depth = 3
+	withConfig(t, c)
+	prevHistory := history
+	t.Cleanup(func() { history = prevHistory })
+	history = make(map[string][]historyEntry)
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := &batteryMetrics{Info: &BatteryInfo{Status: "Discharging"}, Percentage: float64(90 - i)}
+		recordHistory("BAT0", m, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	mux := newMux()
+	rec := get(mux, "/history?battery=BAT0")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /history?battery=BAT0 = %d", rec.Code)
+	}
+	var entries []historyEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	// Only the newest depth entries, oldest first
+	if len(entries) != 3 || entries[0].Percentage != 88 || entries[2].Percentage != 86 {
+		t.Fatalf("entries = %+v, want percentages 88, 87, 86", entries)
+	}
+	if !entries[2].Time.Equal(start.Add(4 * time.Minute)) {
+		t.Errorf("last entry at %v", entries[2].Time)
+	}
+
+	var all map[string][]historyEntry
+	if err := json.Unmarshal(get(mux, "/history").Body.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all["BAT0"]) != 3 {
+		t.Errorf("all batteries = %+v", all)
+	}
+	if rec := get(mux, "/history?battery=BAT9"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown battery = %d, want 404", rec.Code)
+	}
+}
+
+func TestHealthBaseline(t *testing.T) {
+	resetBatteryState(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if got := updateHealthBaseline("BAT0", 80, start); got != 80 {
+		t.Fatalf("first sample = %v, want 80", got)
+	}
+	// A later, higher reading in the same hour keeps the minimum
+	if got := updateHealthBaseline("BAT0", 92, start.Add(30*time.Minute)); got != 80 {
+		t.Errorf("same hour = %v, want 80", got)
+	}
+	for h := 1; h < 24; h++ {
+		if got := updateHealthBaseline("BAT0", 90, start.Add(time.Duration(h)*time.Hour)); got != 80 {
+			t.Fatalf("hour %d = %v, want 80", h, got)
+		}
+	}
+	// 24 hours on, the dip has left the window
+	if got := updateHealthBaseline("BAT0", 91, start.Add(24*time.Hour)); got != 90 {
+		t.Errorf("after 24h = %v, want 90", got)
+	}
+}
+
+func TestInternalResistance(t *testing.T) {
+	tests := []struct {
+		name string
+		info BatteryInfo
+		want float64
+	}{
+		// 12.6 V open circuit sagging to 12.3 V at 2 A: 0.15 Ω
+		{"discharging", BatteryInfo{Status: "Discharging", VoltageOCV: 12600000, HasVoltageOCV: true, VoltageNow: 12300000, CurrentNow: -2000000, HasCurrentNow: true}, 0.15},
+		{"charging", BatteryInfo{Status: "Charging", VoltageOCV: 12000000, HasVoltageOCV: true, VoltageNow: 12200000, CurrentNow: 1000000, HasCurrentNow: true}, 0.2},
+		{"negative sag", BatteryInfo{Status: "Discharging", VoltageOCV: 12000000, HasVoltageOCV: true, VoltageNow: 12100000, CurrentNow: 1000000, HasCurrentNow: true}, 0},
+		{"small current", BatteryInfo{Status: "Discharging", VoltageOCV: 12600000, HasVoltageOCV: true, VoltageNow: 12590000, CurrentNow: 10000, HasCurrentNow: true}, -1},
+		{"idle", BatteryInfo{Status: "Full", VoltageOCV: 12600000, HasVoltageOCV: true, VoltageNow: 12500000, CurrentNow: 1000000, HasCurrentNow: true}, -1},
+		{"no ocv", BatteryInfo{Status: "Discharging", VoltageNow: 12300000, CurrentNow: 2000000, HasCurrentNow: true}, -1},
+	}
+	for _, tt := range tests {
+		if got := internalResistance(&tt.info); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: internalResistance = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFieldMapCollisions(t *testing.T) {
+	tests := []struct {
+		fieldMap string
+		ok       bool
+	}{
+		{"percentage: charge_pct", true},
+		{"percentage: voltage", false},
+		{"percentage: cell_voltage_1", false},
+		// voltage moves out of the way, so percentage may take its name
+		{"percentage: voltage\n    voltage: volts", true},
+		{"percentage: x\n    voltage: x", false},
+	}
+	for _, tt := range tests {
+		cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+		yml := "influxdb:\n  field_map:\n    " + tt.fieldMap + "\n"
+		if err := os.WriteFile(cfg, []byte(yml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		withConfig(t, Config{})
+		err := loadConfig(cfg)
+		if (err == nil) != tt.ok {
+			t.Errorf("field_map %q: err = %v, want ok %t", tt.fieldMap, err, tt.ok)
+		}
+	}
+}
+
+func TestRenameFields(t *testing.T) {
+	var c Config
+	c.InfluxDB.FieldMap = map[string]string{"percentage": "voltage", "voltage": "volts"}
+	withConfig(t, c)
+	got := renameFields(map[string]interface{}{"percentage": 55.0, "voltage": 11.9, "status": "Full"})
+	want := map[string]interface{}{"voltage": 55.0, "volts": 11.9, "status": "Full"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renameFields = %v, want %v", got, want)
+	}
+}
+
+func TestStatusElapsedGap(t *testing.T) {
+	withConfig(t, Config{Interval: 10})
+	resetBatteryState(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if got := statusElapsed("BAT0", start); got != 0 {
+		t.Errorf("first sample = %v, want 0", got)
+	}
+	if got := statusElapsed("BAT0", start.Add(10*time.Second)); got != 10*time.Second {
+		t.Errorf("next poll = %v, want 10s", got)
+	}
+	if got := statusElapsed("BAT0", start.Add(8*time.Hour)); got != 0 {
+		t.Errorf("after a gap = %v, want 0", got)
+	}
+}
+
+func TestTimeInState(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"BAT0/uevent": "POWER_SUPPLY_STATUS=Charging\n"})
+	withConfig(t, Config{SysfsPath: root, Interval: 10})
+	resetBatteryState(t)
+	initTestMetrics(t)
+	out := &outputs{}
+	inState := func(state string) float64 {
+		return testutil.ToFloat64(promCounters["time_in_state"].WithLabelValues("BAT0", "", state))
+	}
+
+	// The first sample has nothing to credit
+	updateBattery("BAT0", out)
+	if n := testutil.CollectAndCount(promCounters["time_in_state"]); n != 0 {
+		t.Fatalf("%d series after the first sample, want 0", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	updateBattery("BAT0", out)
+	charging := inState("Charging")
+	if charging < 0.02 {
+		t.Fatalf("charging = %vs, want at least 0.02", charging)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "BAT0", "uevent"), []byte("POWER_SUPPLY_STATUS=Discharging\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	updateBattery("BAT0", out)
+	if got := inState("Discharging"); got < 0.02 {
+		t.Errorf("discharging = %vs, want at least 0.02", got)
+	}
+	if got := inState("Charging"); got != charging {
+		t.Errorf("charging grew to %vs while discharging", got)
+	}
+}
+
+func TestBatteryFieldNamesComplete(t *testing.T) {
+	withConfig(t, Config{HealthBaseline: true})
+	info := &BatteryInfo{HasChargeCounter: true, HasVoltageOCV: true, HasCapacityErrorMargin: true, HasTemp: true, HasLearnedFull: true, HasPowerNow: true, CellVoltages: []float64{3.9, 3.9}, CapacityLevel: "Normal"}
+	m := &batteryMetrics{Info: info, WarmedUp: true, Cells: 3, ChargeTarget: 80, HasChargeControl: true, InternalResistance: 0.1, Discrepancy: 1, TimeToEmpty: 60, TimeToFull: 60}
+	for name := range batteryFields(m) {
+		if !slices.Contains(batteryFieldNames, name) && !cellVoltageField.MatchString(name) {
+			t.Errorf("field %s is missing from batteryFieldNames", name)
+		}
+	}
+}
+
+// fakeKafkaWriter records the messages a kafkaOutput produces.
+type fakeKafkaWriter struct {
+	msgs []kafka.Message
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *fakeKafkaWriter) Close() error { return nil }
+
+func TestKafkaPublish(t *testing.T) {
+	for _, serverTimestamps := range []bool{false, true} {
+		withConfig(t, Config{Host: "laptop", ServerTimestamps: serverTimestamps})
+		w := &fakeKafkaWriter{}
+		o := &kafkaOutput{writer: w}
+		now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		readings := map[string]*batteryMetrics{
+			"BAT0": {Info: &BatteryInfo{Name: "BAT0", Status: "Discharging"}, Percentage: 42},
+		}
+		if err := o.publish(newCyclePayload(readings, now)); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.msgs) != 1 {
+			t.Fatalf("%d messages, want 1", len(w.msgs))
+		}
+		msg := w.msgs[0]
+		if string(msg.Key) != "laptop" {
+			t.Errorf("key = %q, want laptop", msg.Key)
+		}
+		if serverTimestamps != msg.Time.IsZero() {
+			t.Errorf("server_timestamps %t: message time %v", serverTimestamps, msg.Time)
+		}
+		var got cyclePayload
+		if err := json.Unmarshal(msg.Value, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Host != "laptop" || !got.Time.Equal(now) || got.Batteries["BAT0"]["percentage"] != 42.0 {
+			t.Errorf("payload = %+v", got)
+		}
+	}
+}
+
+func TestKafkaWriterSendsImmediately(t *testing.T) {
+	var c Config
+	c.Kafka.Enabled = true
+	withConfig(t, c)
+	if _, err := newKafkaOutput(); err == nil {
+		t.Error("newKafkaOutput accepted a config without brokers and topic")
+	}
+
+	// A listener that accepts the startup dial
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	c.Kafka.Brokers = []string{ln.Addr().String()}
+	c.Kafka.Topic = "power"
+	withConfig(t, c)
+	o, err := newKafkaOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.writer.Close()
+	if w := o.writer.(*kafka.Writer); w.BatchSize != 1 {
+		t.Errorf("BatchSize = %d, want 1 so a cycle's message is not held for the batch timeout", w.BatchSize)
+	}
+}
+
+// stubBackend is a backend whose init fails the first failures calls.
+type stubBackend struct {
+	mu       sync.Mutex
+	calls    int
+	failures int
+}
+
+func (b *stubBackend) init() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.calls <= b.failures {
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func (b *stubBackend) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
+
+func TestInitBackendPolicy(t *testing.T) {
+	prevInterval := backendRetryInterval
+	t.Cleanup(func() { backendRetryInterval = prevInterval })
+	backendRetryInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		policy  string
+		wantErr bool
+		calls   int
+	}{
+		{"fatal", true, 1},
+		{"warn", false, 1},
+		// Retried until the second attempt succeeds, then left alone
+		{"retry", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			withConfig(t, Config{BackendInit: tt.policy})
+			b := &stubBackend{failures: 1}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := initBackend(ctx, "stub", b.init, func() bool { return true }, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initBackend = %v, want error %t", err, tt.wantErr)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if n := b.count(); n != tt.calls {
+				t.Errorf("init called %d times, want %d", n, tt.calls)
+			}
+		})
+	}
+
+	t.Run("retry stops on cancel", func(t *testing.T) {
+		withConfig(t, Config{})
+		b := &stubBackend{failures: math.MaxInt}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := initBackend(ctx, "stub", b.init, func() bool { return true }, true); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		n := b.count()
+		if n < 2 {
+			t.Fatalf("init called %d times before cancel, want retries", n)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := b.count(); got != n {
+			t.Errorf("init called %d more times after cancel", got-n)
+		}
+	})
+}
+
+func TestThermalThrottled(t *testing.T) {
+	var c Config
+	c.ThermalThrottle.MinChargeCurrentMA = 500
+	withConfig(t, c)
+	tests := []struct {
+		name          string
+		info          BatteryInfo
+		targetReached bool
+		want          bool
+	}{
+		{"cool", BatteryInfo{Status: "Not charging", Temp: 300, Capacity: 50}, false, false},
+		{"hot, not charging", BatteryInfo{Status: "Not charging", Temp: 460, Capacity: 50}, false, true},
+		{"hot, at the charge limit", BatteryInfo{Status: "Not charging", Temp: 460, Capacity: 80}, true, false},
+		{"hot, full", BatteryInfo{Status: "Not charging", Temp: 460, Capacity: 100}, false, false},
+		{"hot, trickle charging", BatteryInfo{Status: "Charging", Temp: 460, CurrentNow: 200000, HasCurrentNow: true}, false, true},
+		{"hot, charging normally", BatteryInfo{Status: "Charging", Temp: 460, CurrentNow: 2000000, HasCurrentNow: true}, false, false},
+		{"hot, no current", BatteryInfo{Status: "Charging", Temp: 460}, false, false},
+		{"hot, discharging", BatteryInfo{Status: "Discharging", Temp: 460}, false, false},
+	}
+	for _, tt := range tests {
+		if got := thermalThrottled(&tt.info, tt.targetReached); got != tt.want {
+			t.Errorf("%s: thermalThrottled = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// captureLog sends the log output to a buffer for the duration of a test.
+func captureLog(t *testing.T) *strings.Builder {
+	t.Helper()
+	var buf strings.Builder
+	prevOut, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(prevOut)
+		log.SetFlags(prevFlags)
+	})
+	return &buf
+}
+
+func TestTrace(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_CAPACITY=50\nPOWER_SUPPLY_SERIAL_NUMBER=SN1234\n",
+	})
+	withConfig(t, Config{SysfsPath: root})
+	resetBatteryState(t)
+	prevTracing, prevRedact := tracing, traceRedact
+	t.Cleanup(func() { tracing, traceRedact = prevTracing, prevRedact })
+
+	for _, redact := range []bool{false, true} {
+		tracing, traceRedact = true, redact
+		buf := captureLog(t)
+		updateBattery("BAT0", &outputs{})
+		logged := buf.String()
+		for _, want := range []string{
+			"trace: BAT0 uevent: POWER_SUPPLY_CAPACITY=50",
+			"trace: BAT0 parsed: ",
+			"trace: BAT0 computed: ",
+			"percentage:50",
+		} {
+			if !strings.Contains(logged, want) {
+				t.Errorf("redact %t: trace is missing %q:\n%s", redact, want, logged)
+			}
+		}
+		if strings.Contains(logged, "SN1234") == redact {
+			t.Errorf("redact %t: serial shown %t:\n%s", redact, !redact, logged)
+		}
+	}
+
+	tracing = false
+	buf := captureLog(t)
+	updateBattery("BAT0", &outputs{})
+	if strings.Contains(buf.String(), "trace:") {
+		t.Errorf("trace output with tracing off:\n%s", buf.String())
+	}
+}
+
+func TestSystemPowerIgnoresPeripherals(t *testing.T) {
+	mouse := &batteryMetrics{Info: &BatteryInfo{Name: "mouse", Scope: "Device", Status: "Discharging", PowerNow: 500000, HasPowerNow: true}}
+	laptop := &batteryMetrics{Info: &BatteryInfo{Name: "BAT0", Scope: "System", Status: "Full", PowerNow: 0, HasPowerNow: true}}
+	readings := map[string]*batteryMetrics{"mouse": mouse, "BAT0": laptop}
+
+	if onBattery(readings, nil) {
+		t.Error("onBattery with only a peripheral discharging")
+	}
+	if w, ok := systemPower(readings, nil); !ok || w != 0 {
+		t.Errorf("systemPower = %v, %t; want 0, true", w, ok)
+	}
+	if _, ok := systemPower(map[string]*batteryMetrics{"mouse": mouse}, nil); ok {
+		t.Error("systemPower from a peripheral alone")
+	}
+
+	laptop.Info.Status = "Discharging"
+	laptop.Info.PowerNow = 8000000
+	if !onBattery(readings, nil) {
+		t.Error("onBattery with the system battery discharging")
+	}
+	if w, ok := systemPower(readings, nil); !ok || w != 8 {
+		t.Errorf("systemPower = %v, %t; want 8, true", w, ok)
+	}
+}
+
+func TestSystemPowerCharging(t *testing.T) {
+	// 65 W in from the adapter, 20 W of it into the battery
+	adapter := &AdapterInfo{Name: "AC", Online: true, PowerNow: 65000000, HasPowerNow: true}
+	laptop := &batteryMetrics{Info: &BatteryInfo{Name: "BAT0", Status: "Charging", PowerNow: 20000000, HasPowerNow: true}}
+	readings := map[string]*batteryMetrics{"BAT0": laptop}
+	if w, ok := systemPower(readings, []*AdapterInfo{adapter}); !ok || math.Abs(w-45) > 1e-9 {
+		t.Errorf("systemPower = %v, %t; want 45, true", w, ok)
+	}
+	if onBattery(readings, []*AdapterInfo{adapter}) {
+		t.Error("onBattery while charging")
+	}
+
+	// Without the adapter's input power the draw is unknown
+	adapter = &AdapterInfo{Name: "AC", Online: true}
+	if _, ok := systemPower(readings, []*AdapterInfo{adapter}); ok {
+		t.Error("systemPower without adapter input power")
+	}
+}
+
+func TestExpireStaleRemovesAllSeries(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_POWER_NOW=10000000\n",
+		"BAT1/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_POWER_NOW=10000000\n",
+	})
+	withConfig(t, Config{SysfsPath: root, Interval: 10, StaleAfter: 60, RescanInterval: -1})
+	resetBatteryState(t)
+	withBatteries(t, "BAT0", "BAT1")
+	reg := initTestMetrics(t)
+	promCounters["ac_plug"].WithLabelValues("AC")
+
+	collectOnce(nil)
+	time.Sleep(10 * time.Millisecond)
+	collectOnce(nil)
+	series := func(battery string) []string {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "battery" && lp.GetValue() == battery {
+						names = append(names, f.GetName())
+					}
+				}
+			}
+		}
+		return names
+	}
+	for _, name := range []string{"battery_percentage", "battery_last_scrape_success", "battery_power_draw_watts", "battery_time_in_state_seconds"} {
+		if !slices.Contains(series("BAT0"), name) {
+			t.Fatalf("no %s series before BAT0 went stale", name)
+		}
+	}
+
+	// BAT0 stops answering and its last read is older than stale_after
+	if err := os.Remove(filepath.Join(root, "BAT0", "uevent")); err != nil {
+		t.Fatal(err)
+	}
+	readTimes["BAT0"] = time.Now().Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		collectOnce(nil)
+		if got := series("BAT0"); len(got) != 0 {
+			t.Errorf("cycle %d: BAT0 series left after going stale: %v", i, got)
+		}
+	}
+	if got := series("BAT1"); !slices.Contains(got, "battery_power_draw_watts") {
+		t.Errorf("BAT1 series = %v, want them kept", got)
+	}
+	if n := testutil.CollectAndCount(promCounters["ac_plug"]); n != 1 {
+		t.Errorf("%d adapter counter series, want it kept", n)
+	}
+}
+
+// fakeUPower serves device properties keyed by object path.
+type fakeUPower map[dbus.ObjectPath]map[string]interface{}
+
+func (f fakeUPower) EnumerateDevices() ([]dbus.ObjectPath, error) {
+	var paths []dbus.ObjectPath
+	for p := range f {
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+func (f fakeUPower) DeviceProperties(path dbus.ObjectPath) (map[string]dbus.Variant, error) {
+	dev, ok := f[path]
+	if !ok {
+		return nil, fmt.Errorf("no such object %s", path)
+	}
+	props := make(map[string]dbus.Variant, len(dev))
+	for k, v := range dev {
+		props[k] = dbus.MakeVariant(v)
+	}
+	return props, nil
+}
+
+func TestUPowerSource(t *testing.T) {
+	fake := fakeUPower{
+		"/org/freedesktop/UPower/devices/line_power_AC": {"Type": uint32(1), "NativePath": "AC"},
+		"/org/freedesktop/UPower/devices/battery_BAT0": {
+			"Type": uint32(2), "NativePath": "BAT0",
+			"State": uint32(2), "Technology": uint32(1),
+			"Percentage": 54.6, "Voltage": 11.9,
+			"Energy": 27.3, "EnergyFull": 45.0, "EnergyFullDesign": 50.0,
+			"EnergyRate": 8.5, "Temperature": 31.2,
+			"Model": "5B10W13930", "Vendor": "SMP", "Serial": "1234",
+			"IsPresent": true, "PowerSupply": true, "ChargeCycles": int32(120),
+		},
+		"/org/freedesktop/UPower/devices/mouse_hidpp_battery_0": {
+			"Type": uint32(5), "NativePath": "/sys/devices/hidpp_battery_0",
+			"State": uint32(4), "Percentage": 100.0, "PowerSupply": false,
+		},
+	}
+	prevConnect, prevDevices := connectUPower, upowerDevices
+	t.Cleanup(func() { connectUPower, upowerDevices = prevConnect, prevDevices })
+	connectUPower = func() (upowerBus, error) { return fake, nil }
+	upowerDevices = make(map[string]dbus.ObjectPath)
+	withConfig(t, Config{Source: "upower"})
+
+	if got := findBatteries(); !slices.Equal(got, []string{"BAT0", "hidpp_battery_0"}) {
+		t.Fatalf("findBatteries() = %v, want [BAT0 hidpp_battery_0]", got)
+	}
+
+	info, err := readBatteryInfo("BAT0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BatteryInfo{
+		Name: "BAT0", Status: "Discharging", Technology: "Li-ion", Capacity: 55,
+		VoltageNow: 11900000, EnergyNow: 27300000, EnergyFull: 45000000, EnergyDesign: 50000000,
+		PowerNow: 8500000, HasPowerNow: true, Temp: 312, HasTemp: true,
+		Model: "5B10W13930", Manufacturer: "SMP", Serial: "1234",
+		Present: true, Scope: "System", CycleCount: 120,
+	}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("BAT0 =\n%+v\nwant\n%+v", *info, want)
+	}
+
+	mouse, err := readBatteryInfo("hidpp_battery_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mouse.Scope != "Device" || mouse.Status != "Full" || mouse.HasPowerNow || mouse.HasTemp {
+		t.Errorf("mouse = %+v, want a full Device battery without rate or temperature", *mouse)
+	}
+	if _, err := readBatteryInfo("BAT9"); err == nil {
+		t.Error("read an unknown UPower device")
+	}
+}
+
+func TestLabelBySerial(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_CAPACITY=50\nPOWER_SUPPLY_SERIAL_NUMBER= 1234 \n",
+		"BAT1/uevent": "POWER_SUPPLY_CAPACITY=70\n",
+	})
+	withConfig(t, Config{SysfsPath: root, LabelBy: "serial"})
+	resetBatteryState(t)
+	withBatteries(t, "BAT0", "BAT1")
+	initTestMetrics(t)
+	out := &outputs{}
+
+	updateBattery("BAT0", out)
+	updateBattery("BAT1", out)
+	if got := testutil.ToFloat64(batteryGauges["percentage"].WithLabelValues("1234", "")); got != 50 {
+		t.Errorf("BAT0 by serial = %v, want 50", got)
+	}
+	// Without a serial the name is used
+	if got := testutil.ToFloat64(batteryGauges["percentage"].WithLabelValues("BAT1", "")); got != 70 {
+		t.Errorf("BAT1 by name = %v, want 70", got)
+	}
+
+	// A swapped pack replaces the old pack's series
+	if err := os.WriteFile(filepath.Join(root, "BAT0", "uevent"), []byte("POWER_SUPPLY_CAPACITY=90\nPOWER_SUPPLY_SERIAL_NUMBER=5678\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updateBattery("BAT0", out)
+	if got := testutil.ToFloat64(batteryGauges["percentage"].WithLabelValues("5678", "")); got != 90 {
+		t.Errorf("new pack = %v, want 90", got)
+	}
+	if n := testutil.CollectAndCount(batteryGauges["percentage"]); n != 2 {
+		t.Errorf("%d percentage series after the swap, want 2", n)
+	}
+}
+
+func TestValidateInterval(t *testing.T) {
+	tests := []struct {
+		interval, minInterval float64
+		err                   string // expected error, empty for none
+		logged                string // expected log message, empty for none
+	}{
+		{0, 0, "", "interval not set, using the default of 10s"},
+		{-5, 0, "invalid interval -5: must not be negative", ""},
+		{10, -1, "invalid min_interval -1: must not be negative", ""},
+		{0.5, 0, "", "Warning: interval 0.5s is below 1s"},
+		{3, 5, "", "Warning: interval 3s is below 5s"},
+		{0.5, 0.2, "", ""},
+		{10, 0, "", ""},
+	}
+	for _, tt := range tests {
+		withConfig(t, Config{Interval: tt.interval, MinInterval: tt.minInterval})
+		buf := captureLog(t)
+		err := validateInterval()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("interval %v, min %v: err = %v, want %q", tt.interval, tt.minInterval, err, tt.err)
+		}
+		if logged := buf.String(); tt.logged == "" && logged != "" || !strings.Contains(logged, tt.logged) {
+			t.Errorf("interval %v, min %v: logged %q, want %q", tt.interval, tt.minInterval, logged, tt.logged)
+		}
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		var c Config
+		c.Prometheus.NativeHistograms = native
+		withConfig(t, c)
+		reg := initTestMetrics(t)
+		for _, w := range []float64{3.2, 7.5, 12.1} {
+			promHists["power_draw"].WithLabelValues("BAT0", "").Observe(w)
+		}
+
+		f := findFamily(t, reg, "battery_power_draw_watts")
+		if f == nil || len(f.GetMetric()) != 1 {
+			t.Fatalf("native %t: battery_power_draw_watts = %v", native, f)
+		}
+		h := f.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 3 {
+			t.Errorf("native %t: %d samples, want 3", native, h.GetSampleCount())
+		}
+		// Native histograms carry a schema and sparse spans, and still
+		// the classic buckets for scrapers without native support
+		if (h.Schema != nil) != native || (len(h.GetPositiveSpan()) > 0) != native {
+			t.Errorf("native %t: schema %v, %d positive spans", native, h.Schema, len(h.GetPositiveSpan()))
+		}
+		if len(h.GetBucket()) != 10 {
+			t.Errorf("native %t: %d classic buckets, want 10", native, len(h.GetBucket()))
+		}
+	}
+}
+
+func TestSplitRegistries(t *testing.T) {
+	var pushed []string
+	var pushMu sync.Mutex
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			pushMu.Lock()
+			pushed = append(pushed, mf.GetName())
+			pushMu.Unlock()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(gateway.Close)
+
+	loadTestConfig(t, "prometheus:\n"+
+		"  metrics: [battery_percentage, battery_voltage_volts]\n"+
+		"pushgateway:\n"+
+		"  url: "+gateway.URL+"\n"+
+		"  metrics: [battery_energy_wh]\n")
+	initTestMetrics(t)
+	prevRegistry := pushRegistry
+	t.Cleanup(func() {
+		pushRegistry = prevRegistry
+		pushRegistryOnce = sync.Once{}
+	})
+	pushRegistryOnce = sync.Once{}
+	for _, key := range []string{"percentage", "voltage", "energy_now"} {
+		batteryGauges[key].WithLabelValues("BAT0", "").Set(1)
+	}
+
+	pushMetrics()
+	pushMu.Lock()
+	defer pushMu.Unlock()
+	if !slices.Equal(pushed, []string{"battery_energy_wh"}) {
+		t.Errorf("pushed %v, want [battery_energy_wh]", pushed)
+	}
+
+	body := get(newMux(), "/metrics").Body.String()
+	var scraped []string
+	for _, line := range strings.Split(body, "\n") {
+		if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			scraped = append(scraped, strings.Fields(name)[0])
+		}
+	}
+	if !slices.Equal(scraped, []string{"battery_percentage", "battery_voltage_volts"}) {
+		t.Errorf("scraped %v, want [battery_percentage battery_voltage_volts]", scraped)
+	}
+}
+
+func TestPercentageDiscrepancy(t *testing.T) {
+	tests := []struct {
+		name          string
+		threshold     float64
+		info          BatteryInfo
+		discrepancy   float64
+		miscalibrated float64
+	}{
+		// 20 of 40 Wh is 50%, as reported
+		{"agrees", 0, BatteryInfo{Capacity: 50, EnergyNow: 20000000, EnergyFull: 40000000}, 0, 0},
+		{"off by 15", 0, BatteryInfo{Capacity: 65, EnergyNow: 20000000, EnergyFull: 40000000}, 15, 1},
+		{"off by 15, threshold 20", 20, BatteryInfo{Capacity: 65, EnergyNow: 20000000, EnergyFull: 40000000}, 15, 0},
+		{"off by 5", 0, BatteryInfo{Capacity: 45, EnergyNow: 20000000, EnergyFull: 40000000}, 5, 0},
+		{"charge based", 0, BatteryInfo{Capacity: 80, ChargeNow: 1500000, ChargeFull: 3000000}, 30, 1},
+		{"unknown full", 0, BatteryInfo{Capacity: 50}, -1, 0},
+	}
+	for _, tt := range tests {
+		withConfig(t, Config{MiscalibrationThreshold: tt.threshold})
+		resetBatteryState(t)
+		tt.info.Name = "BAT0"
+		m := computeMetrics(&tt.info, time.Now())
+		if math.Abs(m.Discrepancy-tt.discrepancy) > 1e-9 || m.Miscalibrated != tt.miscalibrated {
+			t.Errorf("%s: discrepancy %v, miscalibrated %v; want %v, %v", tt.name, m.Discrepancy, m.Miscalibrated, tt.discrepancy, tt.miscalibrated)
+		}
+	}
+}
+
+func TestFindPowercapZones(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"intel-rapl/enabled":                               "1\n",
+		"intel-rapl/intel-rapl:0/name":                     "package-0\n",
+		"intel-rapl/intel-rapl:0/energy_uj":                "1000\n",
+		"intel-rapl/intel-rapl:0/constraint_0_name":        "long_term\n",
+		"intel-rapl/intel-rapl:0/intel-rapl:0:0/name":      "core\n",
+		"intel-rapl/intel-rapl:0/intel-rapl:0:0/energy_uj": "100\n",
+		"intel-rapl/intel-rapl:0/intel-rapl:0:1/name":      "dram\n",
+		"intel-rapl/intel-rapl:0/intel-rapl:0:1/energy_uj": "200\n",
+		"intel-rapl/intel-rapl:1/name":                     "package-1\n",
+		"intel-rapl/intel-rapl:1/energy_uj":                "3000\n",
+		"intel-rapl/intel-rapl:1/intel-rapl:1:0/name":      "dram\n",
+		"intel-rapl/intel-rapl:1/intel-rapl:1:0/energy_uj": "300\n",
+		// The flat links to every zone are not walked
+		"intel-rapl:0/name":      "package-0\n",
+		"intel-rapl:0/energy_uj": "1000\n",
+		"intel-rapl:0:0/name":    "core\n",
+	})
+	want := []powercapZone{
+		{filepath.Join(root, "intel-rapl/intel-rapl:0"), "package-0"},
+		{filepath.Join(root, "intel-rapl/intel-rapl:0/intel-rapl:0:0"), "core"},
+		{filepath.Join(root, "intel-rapl/intel-rapl:0/intel-rapl:0:1"), "dram"},
+		{filepath.Join(root, "intel-rapl/intel-rapl:1"), "package-1"},
+		// The second dram is told apart by its parent
+		{filepath.Join(root, "intel-rapl/intel-rapl:1/intel-rapl:1:0"), "package-1/dram"},
+	}
+	if got := findPowercapZones(root); !reflect.DeepEqual(got, want) {
+		t.Errorf("findPowercapZones =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestUpdatePowercapUsesSysfsPath(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"power_supply/BAT0/uevent":                   "POWER_SUPPLY_CAPACITY=50\n",
+		"powercap/intel-rapl/intel-rapl:0/name":      "package-0\n",
+		"powercap/intel-rapl/intel-rapl:0/energy_uj": "1000000\n",
+	})
+	withConfig(t, Config{SysfsPath: filepath.Join(root, "power_supply")})
+	prevSamples := powercapSamples
+	t.Cleanup(func() { powercapSamples = prevSamples })
+	powercapSamples = make(map[string]powercapSample)
+
+	start := time.Now()
+	if got := updatePowercap(start); len(got) != 0 {
+		t.Fatalf("first read = %v, want no values yet", got)
+	}
+	energy := filepath.Join(root, "powercap/intel-rapl/intel-rapl:0/energy_uj")
+	if err := os.WriteFile(energy, []byte("21000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 20 J over 2 s
+	got := updatePowercap(start.Add(2 * time.Second))
+	if w, ok := got["package-0"]; !ok || math.Abs(w-10) > 1e-9 {
+		t.Errorf("updatePowercap = %v, want package-0 at 10 W", got)
+	}
+}
+
+func TestMetricsTarget(t *testing.T) {
+	loadTestConfig(t, "prometheus:\n  exported_instance: laptop\n  metrics: [battery_percentage]\n")
+	initTestMetrics(t)
+	batteryGauges["percentage"].WithLabelValues("BAT0", "").Set(50)
+	mux := newMux()
+
+	tests := []struct {
+		target string
+		code   int
+		want   string
+	}{
+		{"", http.StatusOK, `exported_instance="laptop"`},
+		{"?target=desk.lan:9273", http.StatusOK, `exported_instance="desk.lan:9273"`},
+		{"?target=" + url.QueryEscape(`x"} 1`), http.StatusBadRequest, "invalid target"},
+		{"?target=-bad", http.StatusBadRequest, "invalid target"},
+	}
+	for _, tt := range tests {
+		rec := get(mux, "/metrics"+tt.target)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("GET /metrics%s = %d %q, want %d containing %q", tt.target, rec.Code, rec.Body.String(), tt.code, tt.want)
+		}
+	}
+}
+
+func TestLearnedCapacity(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_CAPACITY=50\n",
+		"BAT1/uevent": "POWER_SUPPLY_CAPACITY=50\n",
+		"BAT2/uevent": "POWER_SUPPLY_CAPACITY=50\n",
+		// A vendor log of "timestamp value" lines, newest last
+		"vendor/bat0_fcc_log": "1700000000 50120\n1700086400 49870\n1700172800 49650\n\n",
+		"vendor/bat1_fcc":     "48500000\n",
+		"vendor/bat2_fcc":     "n/a\n",
+	})
+	loadTestConfig(t, "sysfs_path: "+root+"\n"+
+		"learned_capacity:\n"+
+		"  BAT0: {path: "+filepath.Join(root, "vendor/bat0_fcc_log")+", unit: mWh}\n"+
+		"  BAT1: {path: "+filepath.Join(root, "vendor/bat1_fcc")+"}\n"+
+		"  BAT2: {path: "+filepath.Join(root, "vendor/bat2_fcc")+"}\n")
+
+	tests := []struct {
+		battery string
+		wh      float64
+		ok      bool
+	}{
+		{"BAT0", 49.65, true},
+		{"BAT1", 48.5, true},
+		{"BAT2", 0, false},
+	}
+	for _, tt := range tests {
+		info, err := readBatteryInfo(tt.battery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.HasLearnedFull != tt.ok || math.Abs(info.LearnedFullWh-tt.wh) > 1e-9 {
+			t.Errorf("%s: learned %v Wh (%t), want %v (%t)", tt.battery, info.LearnedFullWh, info.HasLearnedFull, tt.wh, tt.ok)
+		}
+	}
+}
+
+func TestInfluxGzip(t *testing.T) {
+	f := &fakeInflux{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	var c Config
+	c.InfluxDB.Enabled = true
+	c.InfluxDB.URL = srv.URL
+	c.InfluxDB.Org = "org"
+	c.InfluxDB.Bucket = "bucket"
+	c.InfluxDB.Blocking = true
+	c.InfluxDB.GZip = true
+	c.InfluxDB.Consistency = "all"
+	withConfig(t, c)
+	o, err := newInfluxOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(o.client.Close)
+
+	if err := o.writePoint(testPoint()); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.writes) != 1 {
+		t.Fatalf("%d writes, want 1", len(f.writes))
+	}
+	if enc := f.writes[0].Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", enc)
+	}
+	if q := f.writes[0].URL.Query().Get("consistency"); q != "all" {
+		t.Errorf("consistency = %q, want all", q)
+	}
+}
+
+func TestCellVoltages(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent":      "POWER_SUPPLY_CAPACITY=50\n",
+		"vendor/bat0_cell": "4012, 3998,4005\n",
+	})
+	loadTestConfig(t, "sysfs_path: "+root+"\n"+
+		"cell_voltages:\n"+
+		"  BAT0: {path: "+filepath.Join(root, "vendor/bat0_cell")+", unit: mV}\n")
+	resetBatteryState(t)
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+
+	m := updateBattery("BAT0", &outputs{})
+	want := map[string]float64{"1": 4.012, "2": 3.998, "3": 4.005}
+	if n := testutil.CollectAndCount(batteryGauges["cell_voltage"]); n != len(want) {
+		t.Errorf("%d cell series, want %d", n, len(want))
+	}
+	fields := batteryFields(m)
+	for cell, v := range want {
+		if got := testutil.ToFloat64(batteryGauges["cell_voltage"].WithLabelValues("BAT0", "", cell)); math.Abs(got-v) > 1e-9 {
+			t.Errorf("cell %s = %v V, want %v", cell, got, v)
+		}
+		if got, _ := fields["cell_voltage_"+cell].(float64); math.Abs(got-v) > 1e-9 {
+			t.Errorf("field cell_voltage_%s = %v, want %v", cell, fields["cell_voltage_"+cell], v)
+		}
+	}
+}
+
+func TestScrapeFailureThreshold(t *testing.T) {
+	withConfig(t, Config{ScrapeFailureThreshold: 3})
+	resetBatteryState(t)
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+	success := func() float64 {
+		return testutil.ToFloat64(scrapeSuccess.WithLabelValues("BAT0", ""))
+	}
+
+	recordReadResult("BAT0", true)
+	for i := 1; i < 3; i++ {
+		recordReadResult("BAT0", false)
+		if got := success(); got != 1 {
+			t.Fatalf("after %d failures = %v, want 1", i, got)
+		}
+	}
+	recordReadResult("BAT0", false)
+	if got := success(); got != 0 {
+		t.Fatalf("after 3 failures = %v, want 0", got)
+	}
+	// One good read resets the count
+	recordReadResult("BAT0", true)
+	recordReadResult("BAT0", false)
+	if got := success(); got != 1 {
+		t.Errorf("after recovering and one failure = %v, want 1", got)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_ENERGY_NOW=30000000\nPOWER_SUPPLY_POWER_NOW=10000000\n",
+	})
+	withConfig(t, Config{SysfsPath: root, Interval: 10})
+	resetBatteryState(t)
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+	out := &outputs{}
+
+	m := updateBattery("BAT0", out)
+	if n := testutil.CollectAndCount(batteryGauges["energy_since_full"]); n != 0 {
+		t.Errorf("%d energy_since_full series after the first sample, want 0", n)
+	}
+	if _, ok := batteryFields(m)["energy_since_full"]; ok {
+		t.Error("energy_since_full field after the first sample")
+	}
+
+	m = updateBattery("BAT0", out)
+	if n := testutil.CollectAndCount(batteryGauges["energy_since_full"]); n != 1 {
+		t.Errorf("%d energy_since_full series after the second sample, want 1", n)
+	}
+	if _, ok := batteryFields(m)["energy_since_full"]; !ok {
+		t.Error("no energy_since_full field after the second sample")
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	prevTimes, prevIDs := readTimes, batteryIDs
+	t.Cleanup(func() { readTimes, batteryIDs = prevTimes, prevIDs })
+	read := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	readTimes = map[string]time.Time{"BAT0": read}
+	batteryIDs = map[string]string{"BAT0": "BAT0"}
+
+	var c Config
+	c.ClockOffset = -90.5
+	c.Prometheus.Timestamps = true
+	withConfig(t, c)
+	want := read.Add(-90500 * time.Millisecond)
+	if got := pointTime(read); !got.Equal(want) {
+		t.Errorf("pointTime = %v, want %v", got, want)
+	}
+
+	reg := initTestMetrics(t)
+	batteryGauges["percentage"].WithLabelValues("BAT0", "").Set(50)
+	f := findFamily(t, reg, "battery_percentage")
+	if f == nil || len(f.GetMetric()) != 1 {
+		t.Fatalf("battery_percentage = %v", f)
+	}
+	if got := f.GetMetric()[0].GetTimestampMs(); got != want.UnixMilli() {
+		t.Errorf("scrape timestamp = %d, want %d", got, want.UnixMilli())
+	}
+
+	// server_timestamps leaves the time to the server, offset or not
+	c.ServerTimestamps = true
+	withConfig(t, c)
+	if got := pointTime(read); !got.IsZero() {
+		t.Errorf("pointTime with server_timestamps = %v, want zero", got)
+	}
+}
+
+func TestCollectWhen(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_CAPACITY=50\n",
+		"on":          "0\n",
+	})
+	c := Config{SysfsPath: root, Interval: 10, RescanInterval: -1}
+	c.CollectWhen.File = filepath.Join(root, "on")
+	withConfig(t, c)
+	resetBatteryState(t)
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+	logs := captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A false condition skips the cycle
+	updateMetrics(ctx, &outputs{})
+	if n := testutil.CollectAndCount(batteryGauges["percentage"]); n != 0 {
+		t.Errorf("%d battery_percentage series while collect_when is false, want 0", n)
+	}
+	if !strings.Contains(logs.String(), "pausing collection") {
+		t.Errorf("log = %q, want the pause noted", logs.String())
+	}
+
+	if err := os.WriteFile(c.CollectWhen.File, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	updateMetrics(ctx, &outputs{})
+	if n := testutil.CollectAndCount(batteryGauges["percentage"]); n != 1 {
+		t.Errorf("%d battery_percentage series while collect_when is true, want 1", n)
+	}
+
+	// A slow command does not hold the config lock, so a reload can go
+	// ahead while it runs
+	c.CollectWhen.File = ""
+	c.CollectWhen.Command = "sleep 0.5; exit 1"
+	withConfig(t, c)
+	done := make(chan struct{})
+	go func() {
+		updateMetrics(ctx, &outputs{})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	configMu.Lock()
+	waited := time.Since(start)
+	configMu.Unlock()
+	if waited > 250*time.Millisecond {
+		t.Errorf("config lock waited %v for the collect_when command", waited)
+	}
+	<-done
+}
+
+func TestErrorsEndpoint(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(gateway.Close)
+	t.Cleanup(func() {
+		recentErrors = nil
+		updateErrorSettings()
+	})
+	captureLog(t)
+	root := t.TempDir()
+	loadTestConfig(t, "sysfs_path: "+root+"\n"+
+		"errors:\n  enabled: true\n  depth: 2\n"+
+		"pushgateway:\n  url: "+gateway.URL+"\n")
+	resetBatteryState(t)
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+	prevRegistry := pushRegistry
+	t.Cleanup(func() {
+		pushRegistry = prevRegistry
+		pushRegistryOnce = sync.Once{}
+	})
+	pushRegistryOnce = sync.Once{}
+
+	// BAT0 has no uevent and the gateway rejects pushes; the oldest
+	// error falls out past depth
+	updateBattery("BAT0", &outputs{})
+	pushMetrics()
+	updateBattery("BAT0", &outputs{})
+
+	rec := get(newMux(), "/errors")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/errors status = %d", rec.Code)
+	}
+	var got []errorEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("/errors body %q: %v", rec.Body.String(), err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("%d errors, want depth 2: %+v", len(got), got)
+	}
+	if got[0].Subsystem != "pushgateway" || !strings.Contains(got[0].Message, "Pushgateway error") {
+		t.Errorf("first error = %+v, want the failed push", got[0])
+	}
+	if got[1].Subsystem != "read" || !strings.Contains(got[1].Message, "Error reading BAT0") {
+		t.Errorf("second error = %+v, want the failed read", got[1])
+	}
+	if got[1].Time.Before(got[0].Time) {
+		t.Errorf("errors not oldest first: %+v", got)
+	}
+}
+
+func TestParseACPICallResult(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    []int64
+		wantErr bool
+	}{
+		{"0x2a", []int64{42}, false},
+		{"{0x1, 0x0, 0x11d0}", []int64{1, 0, 4560}, false},
+		{"Error: AE_NOT_FOUND", nil, true},
+		{"not called", nil, true},
+		{"{0x1, garbage}", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseACPICallResult(tt.reply)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseACPICallResult(%q) = %v, %v; want %v, error %t", tt.reply, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestACPICallFillsMissingKeys(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_ENERGY_NOW=30000000\n",
+	})
+	loadTestConfig(t, "interval: 10\nsysfs_path: "+root+"\n"+
+		"acpi_call:\n"+
+		"  BAT0:\n"+
+		"    method: \\_SB.PCI0.LPCB.EC0.BAT0._BST\n"+
+		"    fields: [POWER_SUPPLY_STATUS, \"\", POWER_SUPPLY_ENERGY_NOW, POWER_SUPPLY_VOLTAGE_NOW]\n")
+	prev := acpiCall
+	t.Cleanup(func() { acpiCall = prev })
+	var called string
+	acpiCall = func(method string) ([]int64, error) {
+		called = method
+		return []int64{0x1, 0x5dc, 0x4e20, 0x2ee0}, nil
+	}
+
+	info, err := readBatteryInfo("BAT0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called != `\_SB.PCI0.LPCB.EC0.BAT0._BST` {
+		t.Errorf("called %q", called)
+	}
+	if info.Status != "Discharging" || info.VoltageNow != 12000000 {
+		t.Errorf("status %q, voltage %d µV; want Discharging and 12000000 from acpi_call", info.Status, info.VoltageNow)
+	}
+	if info.EnergyNow != 30000000 {
+		t.Errorf("EnergyNow = %d µWh, want the uevent's 30000000", info.EnergyNow)
+	}
+}
+
+func TestHelpOverride(t *testing.T) {
+	loadTestConfig(t, "interval: 10\n"+
+		"prometheus:\n"+
+		"  help:\n"+
+		"    battery_percentage: State of charge, from the firmware's CAPACITY\n"+
+		"    power_exporter_reloads_total: Reloads since start\n")
+	reg := initTestMetrics(t)
+	batteryGauges["percentage"].WithLabelValues("BAT0", "").Set(50)
+	batteryGauges["voltage"].WithLabelValues("BAT0", "").Set(12)
+
+	body := get(newMux(), "/metrics").Body.String()
+	for _, want := range []string{
+		"# HELP battery_percentage State of charge, from the firmware's CAPACITY\n",
+		"# HELP power_exporter_reloads_total Reloads since start\n",
+		"# HELP battery_voltage_volts Current battery voltage in volts\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics has no %q", want)
+		}
+	}
+	if f := findFamily(t, reg, "battery_percentage"); f.GetHelp() != "State of charge, from the firmware's CAPACITY" {
+		t.Errorf("gathered help = %q", f.GetHelp())
+	}
+
+	// An override for a metric that does not exist is a config error
+	c := config
+	c.Prometheus.Help = map[string]string{"battery_percent": "typo"}
+	withConfig(t, c)
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	if err := initPrometheusMetrics(); err == nil || !strings.Contains(err.Error(), `"battery_percent"`) {
+		t.Errorf("initPrometheusMetrics() = %v, want the unknown metric named", err)
+	}
+}
+
+func TestSQLiteInsertSharedNewColumn(t *testing.T) {
+	var c Config
+	c.SQLite.Enabled = true
+	c.SQLite.Path = filepath.Join(t.TempDir(), "power.db")
+	c.Host = "laptop"
+	withConfig(t, c)
+
+	o, err := newSQLiteOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.db.Close()
+
+	readings := map[string]*batteryMetrics{
+		"BAT0": {Info: &BatteryInfo{Name: "BAT0", Status: "Discharging"}, Percentage: 40},
+		"BAT1": {Info: &BatteryInfo{Name: "BAT1", Status: "Charging"}, Percentage: 90},
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	// Both batteries bring the same new columns in one transaction
+	for i := 0; i < 2; i++ {
+		if err := o.insert(readings, now); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+
+	rows, err := o.db.Query(`SELECT battery, percentage, status FROM battery ORDER BY battery`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	type row struct {
+		battery, status string
+		percentage      float64
+	}
+	var got []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.battery, &r.percentage, &r.status); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	want := []row{
+		{"BAT0", "Discharging", 40},
+		{"BAT0", "Discharging", 40},
+		{"BAT1", "Charging", 90},
+		{"BAT1", "Charging", 90},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSetInfoSeries(t *testing.T) {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "battery_capacity_level_info", Help: "test"},
+		[]string{"battery", "location", "level"})
+	var prev []string
+
+	setInfoSeries(g, &prev, []string{"BAT0", "", "Normal"})
+	setInfoSeries(g, &prev, []string{"BAT0", "", "Normal"})
+	if n := testutil.CollectAndCount(g); n != 1 {
+		t.Fatalf("%d series after an unchanged value, want 1", n)
+	}
+
+	setInfoSeries(g, &prev, []string{"BAT0", "", "Low"})
+	if n := testutil.CollectAndCount(g); n != 1 {
+		t.Fatalf("%d series after a change, want 1", n)
+	}
+	if v := testutil.ToFloat64(g.WithLabelValues("BAT0", "", "Low")); v != 1 {
+		t.Errorf("new series = %v, want 1", v)
+	}
+}
+
+func TestCapacityBand(t *testing.T) {
+	for level, want := range map[string]float64{
+		"Full":     4,
+		"High":     3,
+		"Normal":   3,
+		"Low":      2,
+		"Critical": 1,
+		"Unknown":  0,
+		"":         0,
+		"Bogus":    0,
+	} {
+		if got := capacityBand(level); got != want {
+			t.Errorf("capacityBand(%q) = %v, want %v", level, got, want)
+		}
+	}
+}
+
+// runNATSServer starts an embedded NATS server on a random port.
+func runNATSServer(t *testing.T, jetStream bool) *natsserver.Server {
+	t.Helper()
+	srv, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: jetStream,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestNATSPublishDeliveredOnClose(t *testing.T) {
+	srv := runNATSServer(t, false)
+	var c Config
+	c.Host = "laptop"
+	c.NATS.Enabled = true
+	c.NATS.URL = srv.ClientURL()
+	c.NATS.Subject = "power.laptop"
+	withConfig(t, c)
+
+	sub, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	msgs := make(chan *nats.Msg, 10)
+	if _, err := sub.ChanSubscribe("power.>", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := newNATSOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings := map[string]*batteryMetrics{
+		"BAT0": {Info: &BatteryInfo{Name: "BAT0"}, Percentage: 42},
+	}
+	const n = 5
+	for i := 0; i < n; i++ {
+		if err := o.publish(newCyclePayload(readings, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Everything published before close reaches the server
+	o.close()
+	if !o.conn.IsClosed() {
+		t.Error("connection still open after close")
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-msgs:
+			var got cyclePayload
+			if err := json.Unmarshal(msg.Data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Host != "laptop" || got.Batteries["BAT0"]["percentage"] != 42.0 {
+				t.Errorf("payload = %+v", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d messages", i, n)
+		}
+	}
+}
+
+func TestNATSJetStreamPublish(t *testing.T) {
+	srv := runNATSServer(t, true)
+	var c Config
+	c.NATS.Enabled = true
+	c.NATS.URL = srv.ClientURL()
+	c.NATS.Subject = "power.laptop"
+	c.NATS.JetStream = true
+	withConfig(t, c)
+
+	o, err := newNATSOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := o.js.CreateStream(ctx, jetstream.StreamConfig{Name: "POWER", Subjects: []string{"power.>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := newCyclePayload(map[string]*batteryMetrics{}, time.Now())
+	if err := o.publish(payload); err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("stream has %d messages, want 1", info.State.Msgs)
+	}
+}
+
+func TestChargeDecision(t *testing.T) {
+	tests := []struct {
+		capacity  int
+		inhibited bool
+		want      bool
+	}{
+		{80, false, true}, // at the target
+		{85, false, true},
+		{70, true, true}, // inside the band: keep the current state
+		{70, false, false},
+		{60, true, false}, // at the floor
+		{50, true, false},
+	}
+	for _, tt := range tests {
+		if got := chargeDecision(tt.capacity, 60, 80, tt.inhibited); got != tt.want {
+			t.Errorf("chargeDecision(%d, 60, 80, %t) = %t, want %t", tt.capacity, tt.inhibited, got, tt.want)
+		}
+	}
+}
+
+func TestDesignOverrideChargeBased(t *testing.T) {
+	withConfig(t, Config{DesignCapacityWh: map[string]float64{"BAT0": 48}})
+	resetBatteryState(t)
+
+	// 48 Wh at a nominal 12 V is 4 Ah
+	info := &BatteryInfo{Name: "BAT0", ChargeFull: 3600000, ChargeDesign: 1, VoltageMinDesign: 12000000}
+	applyDesignOverride(info)
+	if info.ChargeDesign != 4000000 {
+		t.Errorf("ChargeDesign = %d µAh, want 4000000", info.ChargeDesign)
+	}
+	if m := computeMetrics(info, time.Now()); math.Abs(m.CapacityHealth-90) > 1e-9 {
+		t.Errorf("health = %v, want 90", m.CapacityHealth)
+	}
+
+	// Without a design voltage the override is refused
+	info = &BatteryInfo{Name: "BAT0", ChargeFull: 3600000, ChargeDesign: 1}
+	applyDesignOverride(info)
+	if info.ChargeDesign != 1 {
+		t.Errorf("ChargeDesign = %d without a design voltage, want it unchanged", info.ChargeDesign)
+	}
+}
+
+func TestChargeControlInhibitAndRelease(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{"BAT0/charge_behaviour": "[auto] inhibit-charge\n"})
+	var c Config
+	c.SysfsPath = root
+	c.ChargeControl = true
+	c.ChargeFloor = map[string]int{"BAT0": 60}
+	c.ChargeTarget = map[string]int{"BAT0": 80}
+	withConfig(t, c)
+	resetBatteryState(t)
+	behaviour := filepath.Join(root, "BAT0", "charge_behaviour")
+
+	m := &batteryMetrics{}
+	applyChargeControl(&BatteryInfo{Name: "BAT0", Capacity: 81}, m)
+	if got := readFile(t, behaviour); got != "inhibit-charge" {
+		t.Fatalf("charge_behaviour = %q, want inhibit-charge", got)
+	}
+	if m.ChargeInhibited != 1 || m.ChargeControlWrites != 1 {
+		t.Errorf("inhibited %v, writes %d; want 1, 1", m.ChargeInhibited, m.ChargeControlWrites)
+	}
+
+	// The kernel shows the selection in brackets
+	if err := os.WriteFile(behaviour, []byte("auto [inhibit-charge]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m = &batteryMetrics{}
+	applyChargeControl(&BatteryInfo{Name: "BAT0", Capacity: 70}, m)
+	if m.ChargeControlWrites != 0 || m.ChargeInhibited != 1 {
+		t.Errorf("inside the band: inhibited %v, writes %d; want 1, 0", m.ChargeInhibited, m.ChargeControlWrites)
+	}
+
+	// Turning control off (or shutting down) lets the battery charge
+	config.ChargeControl = false
+	if chargeControlled("BAT0") {
+		t.Fatal("chargeControlled with charge_control off")
+	}
+	releaseChargeControl("BAT0")
+	if got := readFile(t, behaviour); got != "auto" {
+		t.Errorf("after release charge_behaviour = %q, want auto", got)
+	}
+}
+
+func TestChargeControlThresholdFallback(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/charge_control_start_threshold": "90\n",
+		"BAT0/charge_control_end_threshold":   "100\n",
+	})
+	var c Config
+	c.SysfsPath = root
+	c.ChargeFloor = map[string]int{"BAT0": 60}
+	c.ChargeTarget = map[string]int{"BAT0": 80}
+	withConfig(t, c)
+	resetBatteryState(t)
+
+	m := &batteryMetrics{}
+	applyChargeControl(&BatteryInfo{Name: "BAT0", Capacity: 70}, m)
+	if got := readFile(t, filepath.Join(root, "BAT0", "charge_control_start_threshold")); got != "60" {
+		t.Errorf("start threshold = %q, want 60", got)
+	}
+	if got := readFile(t, filepath.Join(root, "BAT0", "charge_control_end_threshold")); got != "80" {
+		t.Errorf("end threshold = %q, want 80", got)
+	}
+	if m.ChargeControlWrites != 2 {
+		t.Errorf("writes = %d, want 2", m.ChargeControlWrites)
+	}
+}
+
+func TestReloadMetrics(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+	if err := os.WriteFile(cfg, []byte("interval: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(cfg, loaded, loaded); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, Config{})
+	prevMtime := configMtime
+	t.Cleanup(func() { configMtime = prevMtime })
+	if err := loadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	reg := initTestMetrics(t)
+	captureLog(t)
+	mtime := func() float64 {
+		return findFamily(t, reg, "power_exporter_config_mtime_seconds").GetMetric()[0].GetGauge().GetValue()
+	}
+	if got := mtime(); got != float64(loaded.Unix()) {
+		t.Errorf("mtime = %v, want %d", got, loaded.Unix())
+	}
+	if n := testutil.ToFloat64(configReloads); n != 0 {
+		t.Errorf("reloads_total = %v before any reload", n)
+	}
+
+	edited := loaded.Add(time.Hour)
+	if err := os.WriteFile(cfg, []byte("interval: 15\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(cfg, edited, edited); err != nil {
+		t.Fatal(err)
+	}
+	out := &outputs{gen: make(map[string]int)}
+	reloadConfig(cfg, out)
+	if n := testutil.ToFloat64(configReloads); n != 1 {
+		t.Errorf("reloads_total = %v after a reload, want 1", n)
+	}
+	if got := mtime(); got != float64(edited.Unix()) {
+		t.Errorf("mtime after reload = %v, want %d", got, edited.Unix())
+	}
+
+	// A rejected file counts as no reload and keeps the loaded mtime
+	if err := os.WriteFile(cfg, []byte("interval: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(cfg, edited.Add(time.Hour), edited.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(cfg, out)
+	if n := testutil.ToFloat64(configReloads); n != 1 {
+		t.Errorf("reloads_total = %v after a failed reload, want 1", n)
+	}
+	if got := mtime(); got != float64(edited.Unix()) {
+		t.Errorf("mtime after a failed reload = %v, want %d", got, edited.Unix())
+	}
+}
+
+func TestProfileMux(t *testing.T) {
+	rec := get(profileMux(), "/debug/pprof/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Errorf("pprof index = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(profileMux(), "/debug/pprof/cmdline"); rec.Code != http.StatusOK {
+		t.Errorf("pprof cmdline = %d", rec.Code)
+	}
+
+	// The handlers are only on the -profile port, never the metrics one
+	var c Config
+	c.Prometheus.Path = "/metrics"
+	withConfig(t, c)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+		if rec := get(newMux(), path); rec.Code != http.StatusNotFound {
+			t.Errorf("metrics mux %s = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestChargeBasedGauges(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\n" +
+			"POWER_SUPPLY_VOLTAGE_NOW=12000000\n" +
+			"POWER_SUPPLY_CHARGE_FULL_DESIGN=4000000\n" +
+			"POWER_SUPPLY_CHARGE_FULL=3600000\n" +
+			"POWER_SUPPLY_CHARGE_NOW=1800000\n",
+	})
+	withConfig(t, Config{SysfsPath: root, Interval: 10})
+	resetBatteryState(t)
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+
+	updateBattery("BAT0", &outputs{})
+	// 1.8 Ah × 12 V, and 3.6 of 4 Ah design
+	if got := testutil.ToFloat64(batteryGauges["energy_now"].WithLabelValues("BAT0", "")); math.Abs(got-21.6) > 1e-9 {
+		t.Errorf("battery_energy_wh = %v, want 21.6", got)
+	}
+	if got := testutil.ToFloat64(batteryGauges["capacity"].WithLabelValues("BAT0", "")); math.Abs(got-90) > 1e-9 {
+		t.Errorf("battery_capacity_percent = %v, want 90", got)
+	}
+}
+
+func TestTemperatureSeries(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_CAPACITY=50\n",
+		"BAT1/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_CAPACITY=50\nPOWER_SUPPLY_TEMP=312\n",
+	})
+	withConfig(t, Config{SysfsPath: root, Interval: 10})
+	resetBatteryState(t)
+	withBatteries(t, "BAT0", "BAT1")
+	reg := initTestMetrics(t)
+
+	// Without TEMP there is no series rather than a 0 °C one
+	updateBattery("BAT0", &outputs{})
+	if f := findFamily(t, reg, "battery_temperature_celsius"); f != nil {
+		t.Errorf("battery_temperature_celsius without TEMP: %v", f)
+	}
+
+	updateBattery("BAT1", &outputs{})
+	f := findFamily(t, reg, "battery_temperature_celsius")
+	if f == nil || len(f.GetMetric()) != 1 {
+		t.Fatalf("battery_temperature_celsius = %v, want one BAT1 series", f)
+	}
+	if m := f.GetMetric()[0]; m.GetLabel()[0].GetValue() != "BAT1" || math.Abs(m.GetGauge().GetValue()-31.2) > 1e-9 {
+		t.Errorf("series = %v, want BAT1 at 31.2", m)
+	}
+}
+
+func TestReadBatteryInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		uevent string
+		check  func(t *testing.T, info *BatteryInfo)
+	}{
+		{
+			name: "charge based",
+			uevent: "POWER_SUPPLY_STATUS=Discharging\n" +
+				"POWER_SUPPLY_VOLTAGE_NOW=12000000\n" +
+				"POWER_SUPPLY_CHARGE_FULL_DESIGN=4000000\n" +
+				"POWER_SUPPLY_CHARGE_FULL=3600000\n" +
+				"POWER_SUPPLY_CHARGE_NOW=1800000\n" +
+				"POWER_SUPPLY_CAPACITY=50\n",
+			check: func(t *testing.T, info *BatteryInfo) {
+				if !chargeBased(info) {
+					t.Error("not detected as charge based")
+				}
+				if info.ChargeFull != 3600000 || info.ChargeNow != 1800000 || info.ChargeDesign != 4000000 {
+					t.Errorf("charge = %d/%d/%d", info.ChargeNow, info.ChargeFull, info.ChargeDesign)
+				}
+				// 1.8 Ah × 12 V
+				if got := energyNow(info); got != 21600000 {
+					t.Errorf("energyNow = %d µWh, want 21600000", got)
+				}
+			},
+		},
+		{
+			name: "no temp",
+			uevent: "POWER_SUPPLY_STATUS=Charging\n" +
+				"POWER_SUPPLY_ENERGY_NOW=30000000\n",
+			check: func(t *testing.T, info *BatteryInfo) {
+				if info.HasTemp {
+					t.Errorf("HasTemp with no POWER_SUPPLY_TEMP (Temp %d)", info.Temp)
+				}
+				if chargeBased(info) {
+					t.Error("energy battery detected as charge based")
+				}
+			},
+		},
+		{
+			name:   "temp",
+			uevent: "POWER_SUPPLY_TEMP=312\n",
+			check: func(t *testing.T, info *BatteryInfo) {
+				if !info.HasTemp || info.Temp != 312 {
+					t.Errorf("temp = %d (%t), want 312", info.Temp, info.HasTemp)
+				}
+			},
+		},
+		{
+			name:   "charge counter",
+			uevent: "POWER_SUPPLY_CHARGE_COUNTER=-1250000\n",
+			check: func(t *testing.T, info *BatteryInfo) {
+				if !info.HasChargeCounter || info.ChargeCounter != -1250000 {
+					t.Errorf("charge counter = %d (%t), want -1250000", info.ChargeCounter, info.HasChargeCounter)
+				}
+			},
+		},
+		{
+			name: "ocv and error margin",
+			uevent: "POWER_SUPPLY_VOLTAGE_OCV=12600000\n" +
+				"POWER_SUPPLY_CAPACITY_ERROR_MARGIN=3\n",
+			check: func(t *testing.T, info *BatteryInfo) {
+				if !info.HasVoltageOCV || info.VoltageOCV != 12600000 {
+					t.Errorf("OCV = %d (%t), want 12600000", info.VoltageOCV, info.HasVoltageOCV)
+				}
+				if !info.HasCapacityErrorMargin || info.CapacityErrorMargin != 3 {
+					t.Errorf("error margin = %d (%t), want 3", info.CapacityErrorMargin, info.HasCapacityErrorMargin)
+				}
+			},
+		},
+		{
+			name: "unparsable values",
+			uevent: "POWER_SUPPLY_VOLTAGE_OCV=n/a\n" +
+				"POWER_SUPPLY_CHARGE_COUNTER=\n" +
+				"garbage line\n",
+			check: func(t *testing.T, info *BatteryInfo) {
+				if info.HasVoltageOCV || info.HasChargeCounter {
+					t.Errorf("HasVoltageOCV %t, HasChargeCounter %t; want false", info.HasVoltageOCV, info.HasChargeCounter)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fakeSysfs(t, map[string]string{"BAT0/uevent": tt.uevent})
+			withConfig(t, Config{SysfsPath: root})
+			info, err := readBatteryInfo("BAT0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, info)
+		})
+	}
+}
+
+func TestUeventKeyAliases(t *testing.T) {
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "VENDOR_BATT_SOC=77\n" +
+			"VENDOR_BATT_VOLT=11800000\n" +
+			"POWER_SUPPLY_STATUS=Discharging\n",
+	})
+	cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+	yml := "sysfs_path: " + root + "\n" +
+		"uevent_keys:\n" +
+		"  VENDOR_BATT_SOC: Capacity\n" +
+		"  VENDOR_BATT_VOLT: POWER_SUPPLY_VOLTAGE_NOW\n"
+	if err := os.WriteFile(cfg, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, Config{})
+	prevAliases := ueventAliases
+	t.Cleanup(func() { ueventAliases = prevAliases })
+	if err := loadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := readBatteryInfo("BAT0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Capacity != 77 || info.VoltageNow != 11800000 || info.Status != "Discharging" {
+		t.Errorf("capacity %d, voltage %d, status %q; want 77, 11800000, Discharging", info.Capacity, info.VoltageNow, info.Status)
+	}
+}
+
+func TestUeventKeysRejectsUnknownField(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+	if err := os.WriteFile(cfg, []byte("uevent_keys:\n  VENDOR_X: NoSuchField\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, Config{})
+	prevAliases := ueventAliases
+	t.Cleanup(func() { ueventAliases = prevAliases })
+	if err := loadConfig(cfg); err == nil {
+		t.Error("loadConfig accepted an unknown uevent_keys field")
+	}
+}
+
+func TestReloadConfigConcurrentLogError(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+	yml := "interval: 5\nerrors:\n  enabled: true\ninfluxdb:\n  token: s3cret\n"
+	if err := os.WriteFile(cfg, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, Config{})
+	prevAliases := ueventAliases
+	t.Cleanup(func() {
+		ueventAliases = prevAliases
+		recentErrors = nil
+		updateErrorSettings()
+	})
+	if err := loadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := &outputs{gen: make(map[string]int)}
+
+	// Client callbacks log errors without holding configMu
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			logError("influxdb", "write failed with token s3cret")
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		reloadConfig(cfg, out)
+	}
+	<-done
+
+	if got := pollInterval(); got != 5*time.Second {
+		t.Errorf("interval after reload = %v, want 5s", got)
+	}
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	if len(recentErrors) == 0 {
+		t.Fatal("no errors recorded")
+	}
+	if msg := recentErrors[0].Message; msg != "write failed with token <redacted>" {
+		t.Errorf("message = %q, want the token redacted", msg)
+	}
+}
+
+func TestReloadPushgatewayInitFailure(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "power-exporter.yml")
+	if err := os.WriteFile(cfg, []byte("interval: 5\nprometheus:\n  enabled: false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, Config{})
+	if err := loadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Metrics were never set up, as at startup with prometheus and
+	// pushgateway disabled
+	initTestMetrics(t)
+	batteryGauges, scrapeSuccess, configMtimeGauge, configReloads = nil, nil, nil, nil
+	reg := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer, prometheus.DefaultGatherer = reg, reg
+	logs := captureLog(t)
+
+	// A metric of the same name registered elsewhere makes registration
+	// fail halfway through
+	blocker := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "battery_voltage_volts",
+		Help: "Current battery voltage in volts",
+	}, batteryLabels)
+	reg.MustRegister(blocker)
+	blocker.WithLabelValues("BAT0", "").Set(12)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(gateway.Close)
+	yml := "interval: 5\nprometheus:\n  enabled: false\npushgateway:\n  enabled: true\n  url: " + gateway.URL + "\n"
+	if err := os.WriteFile(cfg, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	out := &outputs{ctx: ctx, gen: make(map[string]int)}
+	reloadConfig(cfg, out)
+	if !strings.Contains(logs.String(), "cannot enable pushgateway") {
+		t.Errorf("log = %q, want the failure reported", logs.String())
+	}
+	if config.Pushgateway.Enabled {
+		t.Error("pushgateway enabled without metrics")
+	}
+	if batteryGauges != nil || scrapeSuccess != nil || configReloads != nil {
+		t.Error("collectors of the failed setup kept")
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "battery_voltage_volts" {
+		var names []string
+		for _, f := range families {
+			names = append(names, f.GetName())
+		}
+		t.Errorf("registered after the failed setup: %v, want only the blocker", names)
+	}
+
+	// Once the conflict is gone the next reload sets them up
+	reg.Unregister(blocker)
+	reloadConfig(cfg, out)
+	if !config.Pushgateway.Enabled || batteryGauges == nil {
+		t.Fatalf("pushgateway enabled %t after a clean reload", config.Pushgateway.Enabled)
+	}
+	if !out.snapshot().pushgateway {
+		t.Error("pushgateway not started after a clean reload")
+	}
+	if f := findFamily(t, reg, "power_exporter_reloads_total"); f == nil {
+		t.Error("no reloads_total registered after a clean reload")
+	}
+}
+
+func TestReady(t *testing.T) {
+	withConfig(t, Config{Interval: 10})
+	prevTimes, prevAdapter, prevCount := readTimes, adapterReadTime, batteryCount
+	t.Cleanup(func() { readTimes, adapterReadTime, batteryCount = prevTimes, prevAdapter, prevCount })
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Laptop: battery reads decide
+	readTimes = make(map[string]time.Time)
+	adapterReadTime = now
+	batteryCount = 1
+	if ok, _ := ready(now); ok {
+		t.Error("ready before any battery read")
+	}
+	readTimes["BAT0"] = now.Add(-25 * time.Second)
+	if ok, reason := ready(now); !ok {
+		t.Errorf("not ready with a recent battery read: %s", reason)
+	}
+	readTimes["BAT0"] = now.Add(-31 * time.Second)
+	if ok, _ := ready(now); ok {
+		t.Error("ready with the last read three intervals ago")
+	}
+
+	// Desktop: no batteries, the adapter counts
+	readTimes = make(map[string]time.Time)
+	batteryCount = 0
+	adapterReadTime = time.Time{}
+	if ok, _ := ready(now); ok {
+		t.Error("ready before any adapter read")
+	}
+	adapterReadTime = now.Add(-5 * time.Second)
+	if ok, reason := ready(now); !ok {
+		t.Errorf("adapter-only host not ready: %s", reason)
+	}
+}
+
+func TestLowBattery(t *testing.T) {
+	dir := t.TempDir()
+	ran := filepath.Join(dir, "ran")
+	root := fakeSysfs(t, map[string]string{
+		"BAT0/uevent": "POWER_SUPPLY_STATUS=Discharging\nPOWER_SUPPLY_CAPACITY=10\n",
+	})
+	c := Config{SysfsPath: root, Interval: 10}
+	c.LowBattery.Percent = 20
+	c.LowBattery.Command = `echo "$POWER_EXPORTER_BATTERY $POWER_EXPORTER_PERCENT" >> ` + ran
+	withConfig(t, c)
+	resetBatteryState(t)
+	logs := captureLog(t)
+	fired := func() int { return strings.Count(logs.String(), "running") }
+
+	steps := []struct {
+		capacity int
+		status   string
+		fired    int
+	}{
+		{15, "Discharging", 0}, // already low when first seen
+		{30, "Discharging", 0}, // arms
+		{25, "Discharging", 0},
+		{15, "Discharging", 1}, // crosses
+		{10, "Discharging", 1},
+		{20, "Discharging", 1}, // at the threshold does not re-arm
+		{15, "Discharging", 1},
+		{25, "Charging", 1}, // re-arms
+		{15, "Charging", 1}, // charging does not fire and disarms
+		{15, "Discharging", 1},
+		{21, "Discharging", 1},
+		{19, "Discharging", 2},
+	}
+	for i, s := range steps {
+		checkLowBattery(&BatteryInfo{Name: "BAT0", Capacity: s.capacity, Status: s.status})
+		if got := fired(); got != s.fired {
+			t.Fatalf("step %d (%d%% %s): fired %d times, want %d", i, s.capacity, s.status, got, s.fired)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(ran)
+		if string(data) == "BAT0 15\nBAT0 19\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command output = %q, want BAT0 15 and BAT0 19", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// -status and -tail only read
+	withBatteries(t, "BAT0")
+	initTestMetrics(t)
+	checkLowBattery(&BatteryInfo{Name: "BAT0", Capacity: 50, Status: "Discharging"})
+	prevReadOnly := readOnly
+	t.Cleanup(func() { readOnly = prevReadOnly })
+	readOnly = true
+	updateBattery("BAT0", &outputs{})
+	if got := fired(); got != 2 {
+		t.Errorf("fired %d times with readOnly, want it not run", got)
+	}
+}